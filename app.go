@@ -5,6 +5,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	cache "usicalendar/cache"
 	routes "usicalendar/routes"
 
 	mh "usicalendar/mongo_connection_handler"
@@ -14,17 +15,49 @@ func main() {
 
 	defer mh.Cli.Disconnect(context.Background())
 
+	go cache.MigrateCompression()
+	go cache.ScheduleWarmUp()
+
 	// gin.SetMode(gin.ReleaseMode)
 	gin.SetMode(gin.DebugMode)
 	r := gin.Default()
 	r.SetTrustedProxies(nil)
+	r.Use(routes.RequestDeadline())
 	r.GET("/urlinfo", routes.GetInfoFromUrl)
 	r.GET("/idinfo", routes.GetInfoFromId)
 	r.GET("/shorten", routes.GetShorten)
 	r.GET("/cshorten", routes.GetComplexShorten)
 	r.GET("/s/:shortened", routes.GetShortened)
 	r.GET("/cs/:shortened", routes.GetComplexShortened)
+	r.GET("/s/:shortened/timetable", routes.GetTimetable)
+	r.GET("/cs/:shortened/timetable", routes.GetComplexTimetable)
+	r.GET("/s/:shortened/next", routes.GetNext)
+	r.GET("/cs/:shortened/next", routes.GetComplexNext)
+	r.GET("/s/:shortened/changes.atom", routes.GetChangesAtom)
+	r.GET("/s/:shortened/changes.rss", routes.GetChangesRSS)
+	r.GET("/cs/:shortened/changes.atom", routes.GetComplexChangesAtom)
+	r.GET("/cs/:shortened/changes.rss", routes.GetComplexChangesRSS)
+	r.POST("/s/:shortened/webhooks", routes.PostWebhook)
+	r.POST("/cs/:shortened/webhooks", routes.PostComplexWebhook)
+	r.GET("/s/:shortened/webhooks/:id", routes.GetWebhook)
+	r.GET("/cs/:shortened/webhooks/:id", routes.GetComplexWebhook)
+	r.DELETE("/s/:shortened/webhooks/:id", routes.DeleteWebhook)
+	r.DELETE("/cs/:shortened/webhooks/:id", routes.DeleteComplexWebhook)
 	r.GET("/courses", routes.GetCalendars)
 	r.GET("/extcourses", routes.GetAllCourses)
+	r.GET("/freetime", routes.GetFreeTime)
+	r.GET("/changes", routes.GetChanges)
+
+	admin := r.Group("/admin", routes.AdminAuth())
+	admin.GET("/cache", routes.GetCacheEntries)
+	admin.POST("/cache/course/refresh", routes.PostRefreshCourse)
+	admin.DELETE("/cache/course", routes.DeleteCourseCache)
+	admin.POST("/cache/subject/:id/refresh", routes.PostRefreshSubject)
+	admin.DELETE("/cache/subject/:id", routes.DeleteSubjectCache)
+	admin.POST("/warmup", routes.PostWarmUp)
+	admin.GET("/warmup", routes.GetWarmUp)
+	admin.GET("/cachestats", routes.GetCacheStats)
+	admin.GET("/upstreamstats", routes.GetUpstreamStats)
+
 	r.Run(":8080")
 }
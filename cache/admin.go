@@ -0,0 +1,213 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	mh "usicalendar/mongo_connection_handler"
+	utils "usicalendar/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Cache entry as listed by the admin API, without its calendar
+type EntryInfo struct {
+	Kind           string `bson:"-" json:"kind"`
+	Ref            string `bson:"id" json:"ref"`
+	Url            string `bson:"url,omitempty" json:"url,omitempty"`
+	DateAdded      int64  `bson:"date_added" json:"date_added"`
+	Age            int64  `bson:"-" json:"age_seconds"`
+	ExpiresAt      int64  `bson:"expires_at,omitempty" json:"expires_at"`
+	Stale          bool   `bson:"-" json:"stale"`
+	Size           int64  `bson:"size" json:"size"`
+	CompressedSize int64  `bson:"compressed_size" json:"compressed_size"`
+	LastError      string `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	LastErrorAt    int64  `bson:"last_error_at,omitempty" json:"last_error_at,omitempty"`
+}
+
+func cacheColl(kind string) (*mongo.Collection, error) {
+	switch kind {
+	case mh.CacheKindCourse:
+		return mh.CourseCalendarCacheColl, nil
+	case mh.CacheKindSubject:
+		return mh.SubjectCalendarCacheColl, nil
+	}
+
+	return nil, utils.Errorf(utils.ErrInvalidInput, nil, "kind must be %s or %s", mh.CacheKindCourse, mh.CacheKindSubject)
+}
+
+// Entries of the course or subject cache, oldest first
+func ListEntries(ctx context.Context, kind string, skip int64, limit int64) ([]EntryInfo, error) {
+	coll, err := cacheColl(kind)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "date_added", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$skip", Value: skip}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$project", Value: bson.D{
+			{Key: "id", Value: 1},
+			{Key: "url", Value: 1},
+			{Key: "date_added", Value: 1},
+			{Key: "expires_at", Value: 1},
+			{Key: "last_error", Value: 1},
+			{Key: "last_error_at", Value: 1},
+			{Key: "size", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$size", bson.D{{Key: "$strLenBytes", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$data", ""}}}}}}}}},
+			{Key: "compressed_size", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$type", Value: "$data_gz"}}, "binData"}}},
+				bson.D{{Key: "$binarySize", Value: "$data_gz"}},
+				0,
+			}}}},
+		}}},
+	}
+
+	cursor, err := coll.Aggregate(ctx, pipeline)
+
+	if err != nil {
+		return nil, mh.DBError(err, "%s cache entries", kind)
+	}
+
+	entries := []EntryInfo{}
+
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, mh.DBError(err, "%s cache entries", kind)
+	}
+
+	now := time.Now().Unix()
+
+	for i := range entries {
+		entries[i].Kind = kind
+		entries[i].Age = now - entries[i].DateAdded
+		entries[i].ExpiresAt = expiry(entries[i].DateAdded, entries[i].ExpiresAt)
+		entries[i].Stale = stale(entries[i].DateAdded, entries[i].ExpiresAt, now)
+	}
+
+	return entries, nil
+}
+
+// Downloads a course calendar again whatever the age of its cache entry,
+// also when it is in the negative cache. Creates the entry if there is none.
+func RefreshCourseCalendar(ctx context.Context, url *string) (*string, error) {
+	ref, err := utils.ParseCourseUrl(*url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	canonical := ref.Url()
+
+	if err := clearNegative(ctx, mh.CacheKindCourse, ref.ID); err != nil {
+		return nil, err
+	}
+
+	var document mh.CourseCalendarCache
+	err = mh.CourseCalendarCacheColl.FindOne(ctx,
+		bson.D{{Key: "url", Value: bson.D{{Key: "$in", Value: bson.A{canonical, *url}}}}}).Decode(&document)
+
+	if err == mongo.ErrNoDocuments {
+		return FetchCourseCalendar(ctx, &canonical)
+	}
+
+	if err != nil {
+		return nil, mh.DBError(err, "course cache %s", canonical)
+	}
+
+	if !inflate(&document.Data, document.DataGz) {
+		return nil, utils.Errorf(utils.ErrDatabase, nil, "course cache %s is corrupted", canonical)
+	}
+
+	return refreshCourseCache(ctx, &document)
+}
+
+// Downloads a subject calendar again whatever the age of its cache entry,
+// also when it is in the negative cache. Creates the entry if there is none.
+func RefreshSubjectCalendar(ctx context.Context, id *string) (*string, error) {
+	if _, err := utils.SubjectCalendarUrl(*id); err != nil {
+		return nil, err
+	}
+
+	if err := clearNegative(ctx, mh.CacheKindSubject, *id); err != nil {
+		return nil, err
+	}
+
+	var document mh.SubjectCalendarCache
+	err := mh.SubjectCalendarCacheColl.FindOne(ctx, bson.D{{Key: "id", Value: *id}}).Decode(&document)
+
+	if err == mongo.ErrNoDocuments {
+		return FetchSubjectCalendar(ctx, id)
+	}
+
+	if err != nil {
+		return nil, mh.DBError(err, "subject cache %s", *id)
+	}
+
+	if !inflate(&document.Data, document.DataGz) {
+		return nil, utils.Errorf(utils.ErrDatabase, nil, "subject cache %s is corrupted", *id)
+	}
+
+	return refreshSubjectCache(ctx, &document)
+}
+
+// Removes the cache entries and the negative cache entry of a course calendar,
+// ErrNotFound when there was none. The snapshot history is kept.
+func PurgeCourseCalendar(ctx context.Context, url *string) error {
+	ref, err := utils.ParseCourseUrl(*url)
+
+	if err != nil {
+		return err
+	}
+
+	res, err := mh.CourseCalendarCacheColl.DeleteMany(ctx,
+		bson.D{{Key: "url", Value: bson.D{{Key: "$in", Value: bson.A{ref.Url(), *url}}}}})
+
+	if err != nil {
+		return mh.DBError(err, "purging course cache %s", ref.ID)
+	}
+
+	return purged(ctx, mh.CacheKindCourse, ref.ID, res.DeletedCount)
+}
+
+// Removes the cache entry and the negative cache entry of a subject calendar,
+// ErrNotFound when there was none. The snapshot history is kept.
+func PurgeSubjectCalendar(ctx context.Context, id *string) error {
+	res, err := mh.SubjectCalendarCacheColl.DeleteMany(ctx, bson.D{{Key: "id", Value: *id}})
+
+	if err != nil {
+		return mh.DBError(err, "purging subject cache %s", *id)
+	}
+
+	return purged(ctx, mh.CacheKindSubject, *id, res.DeletedCount)
+}
+
+func purged(ctx context.Context, kind string, ref string, deleted int64) error {
+	res, err := mh.NegativeCacheColl.DeleteOne(ctx, bson.D{{Key: "kind", Value: kind}, {Key: "ref", Value: ref}})
+
+	if err != nil {
+		return mh.DBError(err, "negative cache entry of %s %s", kind, ref)
+	}
+
+	if deleted == 0 && res.DeletedCount == 0 {
+		return utils.Errorf(utils.ErrNotFound, nil, "no %s cache entry for %s", kind, ref)
+	}
+
+	utils.Logger.Printf("Purged %s cache %s\n", kind, ref)
+
+	return nil
+}
+
+// Keeps the reason of a failed refresh in the cache document
+func recordRefreshError(coll *mongo.Collection, id primitive.ObjectID, cause error) {
+	_, err := coll.UpdateByID(context.Background(), id, bson.D{{Key: "$set", Value: bson.D{
+		{Key: "last_error", Value: cause.Error()},
+		{Key: "last_error_at", Value: time.Now().Unix()},
+	}}})
+
+	if err != nil {
+		utils.Logger.Println("Could not record refresh error in " + coll.Name() + ": " + err.Error())
+	}
+}
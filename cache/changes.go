@@ -0,0 +1,262 @@
+package cache
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mh "usicalendar/mongo_connection_handler"
+	utils "usicalendar/utils"
+	webhooks "usicalendar/webhooks"
+
+	ics "github.com/arran4/golang-ical"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type scheduleEvent struct {
+	uid       string
+	subject   string
+	summary   string
+	location  string
+	start     time.Time
+	end       time.Time
+	cancelled bool
+	// RRULE, RDATE and EXDATE of the event, empty for single events
+	recurrence string
+}
+
+// Diffs the previous and the refreshed calendar of a cache entry and stores the changes.
+// Runs after the cache has been updated, a failure only loses the change log.
+// Returns the number of changes stored.
+func recordChanges(kind string, ref string, url string, oldRaw *string, newRaw *string) int {
+	if oldRaw == nil || newRaw == nil || *oldRaw == *newRaw {
+		return 0
+	}
+
+	changes := diffCalendars(oldRaw, newRaw)
+
+	if len(changes) == 0 {
+		return 0
+	}
+
+	now := time.Now().Unix()
+	documents := make([]interface{}, len(changes))
+
+	for i := range changes {
+		changes[i].ID = primitive.NewObjectID()
+		changes[i].Kind = kind
+		changes[i].Ref = ref
+		changes[i].Url = url
+		changes[i].DetectedAt = now
+		documents[i] = changes[i]
+	}
+
+	if _, err := mh.ScheduleChangesColl.InsertMany(context.Background(), documents); err != nil {
+		utils.Logger.Println("Could not store schedule changes for " + kind + " " + ref + ": " + err.Error())
+		return 0
+	}
+
+	utils.Logger.Printf("Recorded %d schedule changes for %s %s\n", len(changes), kind, ref)
+
+	webhooks.Notify(kind, ref, changes)
+
+	return len(changes)
+}
+
+// Event level differences between two raw calendars. Events are matched by UID first,
+// then by subject, summary and time so that regenerated UIDs are not reported as changes,
+// and finally by subject and summary on the same day, which is reported as a move.
+// Every pass indexes the unmatched new events, so a refresh is linear in the events.
+func diffCalendars(oldRaw *string, newRaw *string) []mh.ScheduleChange {
+	oldEvents, ok := scheduleEvents(oldRaw)
+	if !ok {
+		return nil
+	}
+
+	newEvents, ok := scheduleEvents(newRaw)
+	if !ok {
+		return nil
+	}
+
+	var changes []mh.ScheduleChange
+
+	matchedOld := make([]bool, len(oldEvents))
+	matchedNew := make([]bool, len(newEvents))
+
+	// pairs every unmatched old event with the first unmatched new event with the same key,
+	// events whose key is empty are left for the next pass
+	match := func(key func(e *scheduleEvent) string) {
+		unmatched := make(map[string][]int)
+
+		for j := range newEvents {
+			if k := key(&newEvents[j]); !matchedNew[j] && k != "" {
+				unmatched[k] = append(unmatched[k], j)
+			}
+		}
+
+		for i := range oldEvents {
+			if matchedOld[i] {
+				continue
+			}
+			k := key(&oldEvents[i])
+			candidates := unmatched[k]
+			if k == "" || len(candidates) == 0 {
+				continue
+			}
+			j := candidates[0]
+			unmatched[k] = candidates[1:]
+			matchedOld[i] = true
+			matchedNew[j] = true
+			if change, changed := compareEvents(&oldEvents[i], &newEvents[j]); changed {
+				changes = append(changes, change)
+			}
+		}
+	}
+
+	match(func(e *scheduleEvent) string {
+		return e.uid
+	})
+	match(func(e *scheduleEvent) string {
+		return e.subject + "\x00" + e.summary + "\x00" + strconv.FormatInt(e.start.Unix(), 10) + "\x00" + strconv.FormatInt(e.end.Unix(), 10)
+	})
+	match(func(e *scheduleEvent) string {
+		return e.subject + "\x00" + e.summary + "\x00" + e.start.Format("2006-01-02")
+	})
+
+	for i := range oldEvents {
+		if !matchedOld[i] {
+			e := &oldEvents[i]
+			changes = append(changes, mh.ScheduleChange{
+				Subject: e.subject, Change: mh.ChangeRemoved, UID: e.uid, Summary: e.summary,
+				OldStart: e.start.Unix(), OldEnd: e.end.Unix(), OldLocation: e.location,
+			})
+		}
+	}
+
+	for j := range newEvents {
+		if !matchedNew[j] {
+			e := &newEvents[j]
+			changes = append(changes, mh.ScheduleChange{
+				Subject: e.subject, Change: mh.ChangeAdded, UID: e.uid, Summary: e.summary,
+				NewStart: e.start.Unix(), NewEnd: e.end.Unix(), NewLocation: e.location,
+			})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changeTime(&changes[i]) < changeTime(&changes[j])
+	})
+
+	return changes
+}
+
+func compareEvents(o *scheduleEvent, n *scheduleEvent) (mh.ScheduleChange, bool) {
+	change := mh.ScheduleChange{
+		Subject: n.subject, UID: n.uid, Summary: n.summary,
+		OldStart: o.start.Unix(), OldEnd: o.end.Unix(), OldLocation: o.location,
+		NewStart: n.start.Unix(), NewEnd: n.end.Unix(), NewLocation: n.location,
+	}
+
+	switch {
+	case n.cancelled && !o.cancelled:
+		change.Change = mh.ChangeCancelled
+	case !o.start.Equal(n.start) || !o.end.Equal(n.end):
+		change.Change = mh.ChangeMoved
+	case o.location != n.location:
+		change.Change = mh.ChangeRoomChanged
+	case o.recurrence != n.recurrence:
+		change.Change = mh.ChangeRecurrence
+		change.OldRecurrence = o.recurrence
+		change.NewRecurrence = n.recurrence
+	default:
+		return change, false
+	}
+
+	return change, true
+}
+
+func changeTime(change *mh.ScheduleChange) int64 {
+	if change.NewStart != 0 {
+		return change.NewStart
+	}
+	return change.OldStart
+}
+
+func scheduleEvents(raw *string) ([]scheduleEvent, bool) {
+	calendar, err := ics.ParseCalendar(strings.NewReader(*raw))
+
+	if err != nil {
+		return nil, false
+	}
+
+	events := make([]scheduleEvent, 0, len(calendar.Events()))
+
+	for _, event := range calendar.Events() {
+		start, err := event.GetStartAt()
+		if err != nil {
+			continue
+		}
+
+		e := scheduleEvent{
+			uid:      event.Id(),
+			subject:  eventSubject(event),
+			summary:  propertyValue(event, ics.ComponentPropertySummary),
+			location: propertyValue(event, ics.ComponentPropertyLocation),
+			start:    start,
+			end:      start,
+		}
+
+		if end, err := event.GetEndAt(); err == nil {
+			e.end = end
+		}
+
+		e.cancelled = strings.EqualFold(propertyValue(event, ics.ComponentPropertyStatus), "CANCELLED")
+		e.recurrence = recurrenceOf(event)
+
+		events = append(events, e)
+	}
+
+	return events, true
+}
+
+// RRULE, RDATE and EXDATE of an event in a canonical form, the dates sorted so that
+// reordered or split date lists compare equal
+func recurrenceOf(event *ics.VEvent) string {
+	var parts []string
+
+	if rule := propertyValue(event, ics.ComponentPropertyRrule); rule != "" {
+		parts = append(parts, "RRULE:"+rule)
+	}
+
+	for _, property := range []ics.ComponentProperty{ics.ComponentPropertyRdate, ics.ComponentPropertyExdate} {
+		var dates []string
+		for i := range event.Properties {
+			if event.Properties[i].IANAToken == string(property) {
+				dates = append(dates, strings.Split(event.Properties[i].Value, ",")...)
+			}
+		}
+		if len(dates) > 0 {
+			sort.Strings(dates)
+			parts = append(parts, string(property)+":"+strings.Join(dates, ","))
+		}
+	}
+
+	return strings.Join(parts, "\n")
+}
+
+// Same identifier as cal.SubjectOf, which cannot be imported from this package
+func eventSubject(event *ics.VEvent) string {
+	if url := propertyValue(event, ics.ComponentPropertyUrl); url != "" {
+		return url
+	}
+	return propertyValue(event, ics.ComponentPropertySummary)
+}
+
+func propertyValue(event *ics.VEvent, property ics.ComponentProperty) string {
+	if prop := event.GetProperty(property); prop != nil {
+		return prop.Value
+	}
+	return ""
+}
@@ -0,0 +1,199 @@
+package cache
+
+import (
+	"context"
+
+	mh "usicalendar/mongo_connection_handler"
+	utils "usicalendar/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Storage used by one collection of cached calendars
+type CollectionStats struct {
+	Documents      int64   `json:"documents"`
+	Uncompressed   int64   `json:"uncompressed_bytes"`
+	Compressed     int64   `json:"compressed_bytes"`
+	Saved          int64   `json:"saved_bytes"`
+	Ratio          float64 `json:"ratio"`
+	NotMigratedYet int64   `json:"not_migrated"`
+}
+
+// Fills data with the calendar a cache document stores compressed in data_gz.
+// Documents written before compression keep the calendar in data and are left as they are.
+func inflate(data *string, compressed []byte) bool {
+	if len(compressed) == 0 {
+		return true
+	}
+
+	raw, err := utils.Decompress(compressed)
+
+	if err != nil {
+		utils.Logger.Println("Could not decompress cached calendar: " + err.Error())
+		return false
+	}
+
+	*data = *raw
+
+	return true
+}
+
+// Update storing raw compressed in a cache document and dropping the uncompressed copy and the last refresh error
+func compressedUpdate(raw *string, dateAdded int64, expiresAt int64) (bson.D, bool) {
+	compressed, err := utils.Compress(raw)
+
+	if err != nil {
+		return nil, false
+	}
+
+	set := bson.D{{Key: "data_gz", Value: compressed}, {Key: "size", Value: len(*raw)}}
+
+	if dateAdded != 0 {
+		set = append(set, bson.E{Key: "date_added", Value: dateAdded})
+	}
+
+	if expiresAt != 0 {
+		set = append(set, bson.E{Key: "expires_at", Value: expiresAt})
+	}
+
+	unset := bson.D{{Key: "data", Value: ""}, {Key: "last_error", Value: ""}, {Key: "last_error_at", Value: ""}}
+
+	return bson.D{{Key: "$set", Value: set}, {Key: "$unset", Value: unset}}, true
+}
+
+// Compresses the cached calendars still stored as text, run once at startup
+func MigrateCompression() {
+	migrated := migrateCollection(mh.CourseCalendarCacheColl) + migrateCollection(mh.SubjectCalendarCacheColl)
+
+	if migrated > 0 {
+		utils.Logger.Printf("Compressed %d cached calendars\n", migrated)
+	}
+}
+
+func migrateCollection(coll *mongo.Collection) int {
+	cursor, err := coll.Find(context.Background(), bson.D{{Key: "data", Value: bson.D{{Key: "$exists", Value: true}}}})
+
+	if err != nil {
+		utils.Logger.Println("Could not migrate " + coll.Name() + ": " + err.Error())
+		return 0
+	}
+
+	defer cursor.Close(context.Background())
+
+	migrated := 0
+
+	for cursor.Next(context.Background()) {
+		var document struct {
+			ID   interface{} `bson:"_id"`
+			Data string      `bson:"data"`
+		}
+
+		if err := cursor.Decode(&document); err != nil {
+			continue
+		}
+
+		update, ok := compressedUpdate(&document.Data, 0, 0)
+
+		if !ok {
+			continue
+		}
+
+		// only migrate documents that have not been refreshed in the meantime
+		filter := bson.D{{Key: "_id", Value: document.ID}, {Key: "data", Value: document.Data}}
+
+		if res, err := coll.UpdateOne(context.Background(), filter, update); err == nil && res.ModifiedCount == 1 {
+			migrated++
+		}
+	}
+
+	return migrated
+}
+
+// Storage used by the course and subject caches and by the snapshot history
+func StorageStats(ctx context.Context) (map[string]CollectionStats, error) {
+	stats := make(map[string]CollectionStats)
+
+	for name, coll := range map[string]*mongo.Collection{
+		"course_cache":  mh.CourseCalendarCacheColl,
+		"subject_cache": mh.SubjectCalendarCacheColl,
+		"snapshots":     mh.CalendarBlobsColl,
+	} {
+		s, err := collectionStats(ctx, coll)
+		if err != nil {
+			return nil, err
+		}
+		stats[name] = s
+	}
+
+	return stats, nil
+}
+
+func collectionStats(ctx context.Context, coll *mongo.Collection) (CollectionStats, error) {
+	var stats CollectionStats
+
+	// blobs keep the compressed calendar in data, cache documents in data_gz
+	compressedField := "$data_gz"
+	if coll == mh.CalendarBlobsColl {
+		compressedField = "$data"
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "documents", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "compressed", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$type", Value: compressedField}}, "binData"}}},
+				bson.D{{Key: "$binarySize", Value: compressedField}},
+				0,
+			}}}}}},
+			{Key: "uncompressed", Value: bson.D{{Key: "$sum", Value: "$size"}}},
+			{Key: "plain", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$type", Value: "$data"}}, "string"}}},
+				1,
+				0,
+			}}}}}},
+			{Key: "plain_size", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$type", Value: "$data"}}, "string"}}},
+				bson.D{{Key: "$strLenBytes", Value: "$data"}},
+				0,
+			}}}}}},
+		}}},
+	}
+
+	cursor, err := coll.Aggregate(ctx, pipeline)
+
+	if err != nil {
+		return stats, mh.DBError(err, "storage stats of %s", coll.Name())
+	}
+
+	var results []struct {
+		Documents    int64 `bson:"documents"`
+		Compressed   int64 `bson:"compressed"`
+		Uncompressed int64 `bson:"uncompressed"`
+		Plain        int64 `bson:"plain"`
+		PlainSize    int64 `bson:"plain_size"`
+	}
+
+	if err := cursor.All(ctx, &results); err != nil {
+		return stats, mh.DBError(err, "storage stats of %s", coll.Name())
+	}
+
+	if len(results) == 0 {
+		return stats, nil
+	}
+
+	r := results[0]
+
+	stats.Documents = r.Documents
+	stats.NotMigratedYet = r.Plain
+	stats.Uncompressed = r.Uncompressed + r.PlainSize
+	stats.Compressed = r.Compressed + r.PlainSize
+	stats.Saved = stats.Uncompressed - stats.Compressed
+
+	if stats.Compressed > 0 {
+		stats.Ratio = float64(stats.Uncompressed) / float64(stats.Compressed)
+	}
+
+	return stats, nil
+}
@@ -1,3 +0,0 @@
-package cache
-
-const _MAX_AGE int64 = 43200
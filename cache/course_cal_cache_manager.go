@@ -3,7 +3,6 @@ package cache
 import (
 	"context"
 	"fmt"
-	"strings"
 	"time"
 
 	mh "usicalendar/mongo_connection_handler"
@@ -14,78 +13,147 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func FetchCourseCalendar(url *string) *string {
+// Course calendar of a course url, cached under the canonical form of the url.
+// Entries cached before the urls were canonicalised are still found by their original url.
+func FetchCourseCalendar(ctx context.Context, url *string) (*string, error) {
+	ref, err := utils.ParseCourseUrl(*url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	canonical := ref.Url()
+
 	var result mh.CourseCalendarCache
-	err := mh.CourseCalendarCacheColl.FindOne(context.Background(), bson.D{{Key: "url", Value: *url}}).Decode(&result)
+	err = mh.CourseCalendarCacheColl.FindOne(ctx,
+		bson.D{{Key: "url", Value: bson.D{{Key: "$in", Value: bson.A{canonical, *url}}}}}).Decode(&result)
 
 	if err != nil && err != mongo.ErrNoDocuments {
-		return nil
+		return nil, mh.DBError(err, "course cache %s", *url)
+	}
+
+	if err == nil && !inflate(&result.Data, result.DataGz) {
+		return nil, utils.Errorf(utils.ErrDatabase, nil, "course cache %s is corrupted", *url)
 	}
 
 	if err == nil {
-		updatedData, updated := updateCourseCache(&result)
+		updatedData, updated := updateCourseCache(ctx, &result)
 		if updated {
-			return updatedData
+			return updatedData, nil
 		}
-		return &result.Data
+		return &result.Data, nil
 	}
 
-	rawCal, e := utils.SimpleGetRequest(url)
-
-	if e {
-		return nil
-	}
+	rawCal, err := fetchCalendar(ctx, mh.CacheKindCourse, ref.ID, canonical)
 
-	if !utils.IsCalendarValid(rawCal) {
-		return nil
+	if err != nil {
+		return nil, err
 	}
 
 	document := mh.CourseCalendarCache{
 		ID:        primitive.NewObjectID(),
-		Url:       *url,
-		CID:       strings.Split((*url), "/")[5],
+		Url:       canonical,
+		CID:       ref.ID,
 		DateAdded: time.Now().Unix(),
-		Data:      *rawCal,
+		Size:      len(*rawCal),
 	}
 
-	res, err := mh.CourseCalendarCacheColl.InsertOne(context.Background(), document)
+	document.ExpiresAt = document.DateAdded + entryTTL(ctx, mh.CacheKindCourse, ref.ID, document.DateAdded, document.DateAdded)
+
+	compressed, err := utils.Compress(rawCal)
+
+	if err != nil {
+		return nil, err
+	}
+
+	document.DataGz = compressed
+
+	res, err := mh.CourseCalendarCacheColl.InsertOne(ctx, document)
 
 	if err != nil || res.InsertedID == nil {
-		fmt.Println(err)
-		return nil
+		return nil, mh.DBError(err, "new course cache %s", canonical)
 	}
 
-	utils.Logger.Println("New course cache " + *url)
+	utils.Logger.Println("New course cache " + canonical)
 
-	return rawCal
+	go recordSnapshot(mh.CacheKindCourse, document.CID, rawCal, document.DateAdded)
+
+	return rawCal, nil
 }
 
-func updateCourseCache(document *mh.CourseCalendarCache) (*string, bool) {
+// Refreshes the cache document once it has expired. A failed refresh is only
+// logged and kept as the last error of the entry, the caller keeps serving the previous calendar.
+func updateCourseCache(ctx context.Context, document *mh.CourseCalendarCache) (*string, bool) {
 
-	if time.Now().Unix()-(*document).DateAdded < _MAX_AGE {
+	if !stale(document.DateAdded, document.ExpiresAt, time.Now().Unix()) {
 		return nil, false
 	}
 
-	rawCal, e := utils.SimpleGetRequest(&document.Url)
+	rawCal, err := refreshCourseCache(ctx, document)
 
-	if e {
+	if err != nil {
+		utils.Logger.Println("Could not refresh course cache " + document.CID + ": " + err.Error())
 		return nil, false
 	}
 
-	if !utils.IsCalendarValid(rawCal) {
-		return nil, false
+	return rawCal, true
+}
+
+// Downloads the calendar of the cache document again and stores it, whatever its age
+func refreshCourseCache(ctx context.Context, document *mh.CourseCalendarCache) (*string, error) {
+
+	rawCal, err := fetchCalendar(ctx, mh.CacheKindCourse, document.CID, document.Url)
+
+	if err != nil {
+		go recordRefreshError(mh.CourseCalendarCacheColl, document.ID, err)
+		return nil, err
 	}
 
-	update := bson.D{{"$set", bson.D{{"data", *rawCal}, {"date_added", time.Now().Unix()}}}}
+	now := time.Now().Unix()
 
-	res, err := mh.CourseCalendarCacheColl.UpdateByID(context.Background(), document.ID, update)
+	ttl := entryTTL(ctx, mh.CacheKindCourse, document.CID, document.ID.Timestamp().Unix(), now)
 
-	if err != nil || res.ModifiedCount != 1 {
-		fmt.Println(err)
-		return nil, false
+	update, ok := compressedUpdate(rawCal, now, now+ttl)
+
+	if !ok {
+		return nil, fmt.Errorf("could not compress course calendar %s", document.CID)
+	}
+
+	// Only the request that read this version of the entry stores the refresh and records its changes
+	res, err := mh.CourseCalendarCacheColl.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: document.ID}, {Key: "date_added", Value: document.DateAdded}}, update)
+
+	if err != nil {
+		return nil, mh.DBError(err, "updating course cache %s", document.CID)
+	}
+
+	if res.MatchedCount != 1 {
+		return currentCourseCache(ctx, document)
 	}
 
 	utils.Logger.Println("Updated course cache " + document.CID)
 
-	return rawCal, true
+	go recordRefresh(mh.CacheKindCourse, document.CID, document.Url, &document.Data, document.DateAdded, rawCal, now)
+
+	return rawCal, nil
+}
+
+// Calendar of a cache entry another request refreshed or purged in the meantime
+func currentCourseCache(ctx context.Context, document *mh.CourseCalendarCache) (*string, error) {
+	var current mh.CourseCalendarCache
+	err := mh.CourseCalendarCacheColl.FindOne(ctx, bson.D{{Key: "_id", Value: document.ID}}).Decode(&current)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, utils.Errorf(utils.ErrNotFound, nil, "course cache %s was purged", document.CID)
+	}
+
+	if err != nil {
+		return nil, mh.DBError(err, "course cache %s", document.CID)
+	}
+
+	if !inflate(&current.Data, current.DataGz) {
+		return nil, utils.Errorf(utils.ErrDatabase, nil, "course cache %s is corrupted", document.CID)
+	}
+
+	return &current.Data, nil
 }
@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	mh "usicalendar/mongo_connection_handler"
+	utils "usicalendar/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// How long a resource search.usi.ch answered 404 for is not requested again, NEGATIVE_CACHE_NOT_FOUND_TTL_MS
+	negativeNotFoundTTL = utils.DurationFromEnv("NEGATIVE_CACHE_NOT_FOUND_TTL_MS", 15*time.Minute)
+	// How long a resource whose answer was rejected is not requested again, NEGATIVE_CACHE_INVALID_TTL_MS
+	negativeInvalidTTL = utils.DurationFromEnv("NEGATIVE_CACHE_INVALID_TTL_MS", 2*time.Minute)
+)
+
+// Error of the live negative cache entry of a resource, nil when there is none
+func negativeLookup(ctx context.Context, kind string, ref string) error {
+	var entry mh.NegativeCacheEntry
+
+	err := mh.NegativeCacheColl.FindOne(ctx, bson.D{
+		{Key: "kind", Value: kind},
+		{Key: "ref", Value: ref},
+		{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: time.Now().Unix()}}},
+	}).Decode(&entry)
+
+	if err != nil {
+		// a failed lookup only means the resource is requested again
+		return nil
+	}
+
+	errorKind := utils.ErrUpstream
+	if entry.Status == 404 {
+		errorKind = utils.ErrNotFound
+	}
+
+	return utils.Errorf(errorKind, nil, "%s %s unavailable until %s, last failure: %s",
+		kind, ref, time.Unix(entry.ExpiresAt, 0).UTC().Format(time.RFC3339), entry.Reason)
+}
+
+// Remembers a failure that depends on the resource and not on the state of search.usi.ch:
+// a 404 or a rejected answer. Timeouts, 5xx and an open circuit breaker are not cached.
+func recordNegative(kind string, ref string, url string, cause error) {
+	var ttl time.Duration
+
+	switch {
+	case errors.Is(cause, utils.ErrNotFound):
+		ttl = negativeNotFoundTTL
+	case errors.Is(cause, utils.ErrBodyTooLarge), errors.Is(cause, utils.ErrUnexpectedContent), errors.Is(cause, utils.ErrInvalidCalendar):
+		ttl = negativeInvalidTTL
+	default:
+		return
+	}
+
+	now := time.Now()
+
+	_, err := mh.NegativeCacheColl.UpdateOne(context.Background(),
+		bson.D{{Key: "kind", Value: kind}, {Key: "ref", Value: ref}},
+		bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "url", Value: url},
+				{Key: "status", Value: utils.UpstreamStatus(cause)},
+				{Key: "reason", Value: cause.Error()},
+				{Key: "date_added", Value: now.Unix()},
+				{Key: "expires_at", Value: now.Add(ttl).Unix()},
+			}},
+			{Key: "$setOnInsert", Value: bson.D{{Key: "_id", Value: primitive.NewObjectID()}}},
+		},
+		options.Update().SetUpsert(true))
+
+	if err != nil {
+		utils.Logger.Println("Could not record negative cache entry of " + kind + " " + ref + ": " + err.Error())
+	}
+}
+
+// Drops the negative cache entry of a resource so that it is requested again
+func clearNegative(ctx context.Context, kind string, ref string) error {
+	if _, err := mh.NegativeCacheColl.DeleteOne(ctx, bson.D{{Key: "kind", Value: kind}, {Key: "ref", Value: ref}}); err != nil {
+		return mh.DBError(err, "negative cache entry of %s %s", kind, ref)
+	}
+
+	return nil
+}
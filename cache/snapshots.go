@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	mh "usicalendar/mongo_connection_handler"
+	utils "usicalendar/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Keeps the history of a cache entry once it has been refreshed: the snapshots of
+// the previous and of the new calendar and the changes between them.
+// The previous snapshot is only stored when the entry has no history yet,
+// the TTL of the entry is shortened when there were changes.
+func recordRefresh(kind string, ref string, url string, oldRaw *string, oldDate int64, newRaw *string, newDate int64) {
+	recordSnapshot(kind, ref, oldRaw, oldDate)
+	recordSnapshot(kind, ref, newRaw, newDate)
+
+	if recordChanges(kind, ref, url, oldRaw, newRaw) > 0 {
+		shortenTTL(kind, ref, newDate)
+	}
+}
+
+// Stores raw as the version of the cache entry valid from validFrom,
+// unless it is the same as the latest version or older than it
+func recordSnapshot(kind string, ref string, raw *string, validFrom int64) {
+	sum := sha256.Sum256([]byte(*raw))
+	hash := hex.EncodeToString(sum[:])
+
+	latest, err := snapshotAt(context.Background(), kind, ref, -1)
+
+	if err != nil && err != mongo.ErrNoDocuments {
+		utils.Logger.Println("Could not read snapshots of " + kind + " " + ref + ": " + err.Error())
+		return
+	}
+
+	if err == nil && (latest.Hash == hash || latest.ValidFrom >= validFrom) {
+		return
+	}
+
+	data, err := utils.Compress(raw)
+
+	if err != nil {
+		return
+	}
+
+	_, err = mh.CalendarBlobsColl.UpdateOne(context.Background(),
+		bson.D{{Key: "_id", Value: hash}},
+		bson.D{{Key: "$setOnInsert", Value: bson.D{{Key: "data", Value: data}, {Key: "size", Value: len(*raw)}}}},
+		options.Update().SetUpsert(true))
+
+	if err != nil {
+		utils.Logger.Println("Could not store calendar blob " + hash + ": " + err.Error())
+		return
+	}
+
+	snapshot := mh.CalendarSnapshot{
+		ID:        primitive.NewObjectID(),
+		Kind:      kind,
+		Ref:       ref,
+		Hash:      hash,
+		ValidFrom: validFrom,
+	}
+
+	if _, err := mh.CalendarSnapshotsColl.InsertOne(context.Background(), snapshot); err != nil {
+		utils.Logger.Println("Could not store snapshot of " + kind + " " + ref + ": " + err.Error())
+		return
+	}
+
+	utils.Logger.Println("New snapshot of " + kind + " " + ref)
+}
+
+// Course calendar as it was cached at the given unix time, ErrNotFound if there is no snapshot that old
+func CourseCalendarAt(ctx context.Context, url *string, at int64) (*string, error) {
+	ref, err := utils.ParseCourseUrl(*url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return calendarAt(ctx, mh.CacheKindCourse, ref.ID, at)
+}
+
+// Subject calendar as it was cached at the given unix time, ErrNotFound if there is no snapshot that old
+func SubjectCalendarAt(ctx context.Context, id *string, at int64) (*string, error) {
+	return calendarAt(ctx, mh.CacheKindSubject, *id, at)
+}
+
+func calendarAt(ctx context.Context, kind string, ref string, at int64) (*string, error) {
+	snapshot, err := snapshotAt(ctx, kind, ref, at)
+
+	if err != nil {
+		return nil, mh.DBError(err, "snapshot of %s %s", kind, ref)
+	}
+
+	var blob mh.CalendarBlob
+
+	if err := mh.CalendarBlobsColl.FindOne(ctx, bson.D{{Key: "_id", Value: snapshot.Hash}}).Decode(&blob); err != nil {
+		return nil, mh.DBError(err, "calendar blob %s", snapshot.Hash)
+	}
+
+	raw, err := utils.Decompress(blob.Data)
+
+	if err != nil {
+		return nil, utils.Errorf(utils.ErrDatabase, err, "calendar blob %s", snapshot.Hash)
+	}
+
+	return raw, nil
+}
+
+// Latest snapshot valid at the given unix time, at < 0 for the latest one
+func snapshotAt(ctx context.Context, kind string, ref string, at int64) (*mh.CalendarSnapshot, error) {
+	filter := bson.D{{Key: "kind", Value: kind}, {Key: "ref", Value: ref}}
+
+	if at >= 0 {
+		filter = append(filter, bson.E{Key: "valid_from", Value: bson.D{{Key: "$lte", Value: at}}})
+	}
+
+	findOptions := options.FindOne()
+	findOptions.SetSort(bson.D{{Key: "valid_from", Value: -1}})
+
+	var snapshot mh.CalendarSnapshot
+
+	if err := mh.CalendarSnapshotsColl.FindOne(ctx, filter, findOptions).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
@@ -13,75 +13,149 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func FetchSubjectCalendar(id *string) *string {
+func FetchSubjectCalendar(ctx context.Context, id *string) (*string, error) {
 	// Check if cache document exists
 	var result mh.SubjectCalendarCache
-	err := mh.SubjectCalendarCacheColl.FindOne(context.Background(), bson.D{{Key: "id", Value: *id}}).Decode(&result)
+	err := mh.SubjectCalendarCacheColl.FindOne(ctx, bson.D{{Key: "id", Value: *id}}).Decode(&result)
 
 	if err != nil && err != mongo.ErrNoDocuments {
-		return nil
+		return nil, mh.DBError(err, "subject cache %s", *id)
+	}
+
+	if err == nil && !inflate(&result.Data, result.DataGz) {
+		return nil, utils.Errorf(utils.ErrDatabase, nil, "subject cache %s is corrupted", *id)
 	}
 
 	if err == nil {
-		updatedData, updated := updateSubjectCache(&result)
+		updatedData, updated := updateSubjectCache(ctx, &result)
 		if updated {
-			return updatedData
+			return updatedData, nil
 		}
-		return &result.Data
+		return &result.Data, nil
 	}
 
-	url := "https://search.usi.ch/courses/" + *id + "/*/schedules/ics"
+	url, err := utils.SubjectCalendarUrl(*id)
 
-	rawCal, e := utils.SimpleGetRequest(&url)
+	if err != nil {
+		return nil, err
+	}
 
-	if e {
-		return nil
+	rawCal, err := fetchCalendar(ctx, mh.CacheKindSubject, *id, url)
+
+	if err != nil {
+		return nil, err
 	}
 
 	document := mh.SubjectCalendarCache{
 		ID:        primitive.NewObjectID(),
 		SID:       *id,
 		DateAdded: time.Now().Unix(),
-		Data:      *rawCal,
+		Size:      len(*rawCal),
+	}
+
+	document.ExpiresAt = document.DateAdded + entryTTL(ctx, mh.CacheKindSubject, *id, document.DateAdded, document.DateAdded)
+
+	compressed, err := utils.Compress(rawCal)
+
+	if err != nil {
+		return nil, err
 	}
 
-	res, err := mh.SubjectCalendarCacheColl.InsertOne(context.Background(), document)
+	document.DataGz = compressed
+
+	res, err := mh.SubjectCalendarCacheColl.InsertOne(ctx, document)
 
 	if err != nil || res.InsertedID == nil {
-		fmt.Println(err)
-		return nil
+		return nil, mh.DBError(err, "new subject cache %s", *id)
 	}
 
 	utils.Logger.Println("New subject cache " + *id)
 
-	return rawCal
+	go recordSnapshot(mh.CacheKindSubject, document.SID, rawCal, document.DateAdded)
+
+	return rawCal, nil
 }
 
-func updateSubjectCache(document *mh.SubjectCalendarCache) (*string, bool) {
+// Refreshes the cache document once it has expired. A failed refresh is only
+// logged and kept as the last error of the entry, the caller keeps serving the previous calendar.
+func updateSubjectCache(ctx context.Context, document *mh.SubjectCalendarCache) (*string, bool) {
 
 	// if cache is too old, update
-	if time.Now().Unix()-(*document).DateAdded < _MAX_AGE {
+	if !stale(document.DateAdded, document.ExpiresAt, time.Now().Unix()) {
 		return nil, false
 	}
 
-	url := "https://search.usi.ch/courses/" + (*document).SID + "/*/schedules/ics"
+	rawCal, err := refreshSubjectCache(ctx, document)
 
-	rawCal, e := utils.SimpleGetRequest(&url)
-
-	if e {
+	if err != nil {
+		utils.Logger.Println("Could not refresh subject cache " + document.SID + ": " + err.Error())
 		return nil, false
 	}
 
-	update := bson.D{{"$set", bson.D{{"data", *rawCal}, {"date_added", time.Now().Unix()}}}}
+	return rawCal, true
+}
 
-	res, err := mh.SubjectCalendarCacheColl.UpdateByID(context.Background(), document.ID, update)
+// Downloads the calendar of the cache document again and stores it, whatever its age
+func refreshSubjectCache(ctx context.Context, document *mh.SubjectCalendarCache) (*string, error) {
 
-	if err != nil || res.ModifiedCount != 1 {
-		fmt.Println(err)
-		return nil, false
+	url, err := utils.SubjectCalendarUrl(document.SID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rawCal, err := fetchCalendar(ctx, mh.CacheKindSubject, document.SID, url)
+
+	if err != nil {
+		go recordRefreshError(mh.SubjectCalendarCacheColl, document.ID, err)
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+
+	ttl := entryTTL(ctx, mh.CacheKindSubject, document.SID, document.ID.Timestamp().Unix(), now)
+
+	update, ok := compressedUpdate(rawCal, now, now+ttl)
+
+	if !ok {
+		return nil, fmt.Errorf("could not compress subject calendar %s", document.SID)
+	}
+
+	// Only the request that read this version of the entry stores the refresh and records its changes
+	res, err := mh.SubjectCalendarCacheColl.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: document.ID}, {Key: "date_added", Value: document.DateAdded}}, update)
+
+	if err != nil {
+		return nil, mh.DBError(err, "updating subject cache %s", document.SID)
+	}
+
+	if res.MatchedCount != 1 {
+		return currentSubjectCache(ctx, document)
 	}
 
 	utils.Logger.Println("Updated cache for subject " + document.SID)
 
-	return rawCal, true
+	go recordRefresh(mh.CacheKindSubject, document.SID, url, &document.Data, document.DateAdded, rawCal, now)
+
+	return rawCal, nil
+}
+
+// Calendar of a cache entry another request refreshed or purged in the meantime
+func currentSubjectCache(ctx context.Context, document *mh.SubjectCalendarCache) (*string, error) {
+	var current mh.SubjectCalendarCache
+	err := mh.SubjectCalendarCacheColl.FindOne(ctx, bson.D{{Key: "_id", Value: document.ID}}).Decode(&current)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, utils.Errorf(utils.ErrNotFound, nil, "subject cache %s was purged", document.SID)
+	}
+
+	if err != nil {
+		return nil, mh.DBError(err, "subject cache %s", document.SID)
+	}
+
+	if !inflate(&current.Data, current.DataGz) {
+		return nil, utils.Errorf(utils.ErrDatabase, nil, "subject cache %s is corrupted", document.SID)
+	}
+
+	return &current.Data, nil
 }
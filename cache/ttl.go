@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	mh "usicalendar/mongo_connection_handler"
+	utils "usicalendar/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	// TTL of an entry before any change has been observed, CACHE_TTL_MS
+	cacheDefaultTTL = seconds(utils.DurationFromEnv("CACHE_TTL_MS", 12*time.Hour))
+	// Bounds of the TTL of every entry, CACHE_MIN_TTL_MS and CACHE_MAX_TTL_MS
+	cacheMinTTL = seconds(utils.DurationFromEnv("CACHE_MIN_TTL_MS", time.Hour))
+	cacheMaxTTL = seconds(utils.DurationFromEnv("CACHE_MAX_TTL_MS", 48*time.Hour))
+)
+
+const (
+	// Period the change frequency of an entry is computed over
+	changeWindow int64 = 14 * 24 * 3600
+	// Changes detected this recently halve the TTL once more
+	recentChange int64 = 2 * 24 * 3600
+)
+
+// Periods of the academic year in which the schedules change often: the start of the semesters
+// and the exam sessions. Days are inclusive, a period may span the end of the year.
+var volatilePeriods = []struct {
+	name     string
+	from, to monthDay
+}{
+	{"winter exam session", monthDay{time.January, 8}, monthDay{time.February, 10}},
+	{"spring semester start", monthDay{time.February, 11}, monthDay{time.March, 20}},
+	{"summer exam session", monthDay{time.June, 1}, monthDay{time.June, 30}},
+	{"autumn exam session and semester start", monthDay{time.August, 20}, monthDay{time.October, 10}},
+}
+
+type monthDay struct {
+	month time.Month
+	day   int
+}
+
+// Comparable position of the day in the year
+func (d monthDay) key() int {
+	return int(d.month)*100 + d.day
+}
+
+func seconds(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
+
+// Whether t falls in one of the volatilePeriods, in the local time of the server
+func volatilePeriod(t time.Time) bool {
+	day := monthDay{t.Month(), t.Day()}.key()
+
+	for _, period := range volatilePeriods {
+		from, to := period.from.key(), period.to.key()
+
+		if from <= to && from <= day && day <= to {
+			return true
+		}
+		if from > to && (day >= from || day <= to) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Seconds the calendar of a cache entry refreshed at now is served before being downloaded again.
+// Every refresh that found changes in the last changeWindow divides the default TTL further, and so
+// do recent changes and the volatile periods of the academic year. An entry observed for the whole
+// window without changes is kept twice as long. since is when the entry was first cached, 0 if unknown.
+func entryTTL(ctx context.Context, kind string, ref string, since int64, now int64) int64 {
+	ttl := cacheDefaultTTL
+
+	detections, err := mh.ScheduleChangesColl.Distinct(ctx, "detected_at", bson.D{
+		{Key: "kind", Value: kind},
+		{Key: "ref", Value: ref},
+		{Key: "detected_at", Value: bson.D{{Key: "$gte", Value: now - changeWindow}}},
+	})
+
+	if err != nil {
+		utils.Logger.Println("Could not read schedule changes of " + kind + " " + ref + ": " + err.Error())
+	}
+
+	var latest int64
+
+	for _, detection := range detections {
+		if at, ok := detection.(int64); ok && at > latest {
+			latest = at
+		}
+	}
+
+	switch {
+	case len(detections) > 0:
+		ttl /= int64(1 + len(detections))
+		if now-latest < recentChange {
+			ttl /= 2
+		}
+	case err == nil && since != 0 && now-since >= changeWindow:
+		ttl *= 2
+	}
+
+	if volatilePeriod(time.Unix(now, 0)) {
+		ttl /= 2
+	}
+
+	if ttl < cacheMinTTL {
+		ttl = cacheMinTTL
+	}
+	if ttl > cacheMaxTTL {
+		ttl = cacheMaxTTL
+	}
+
+	return ttl
+}
+
+// Expiry of an entry, entries cached before the TTLs were computed per entry keep the default one
+func expiry(dateAdded int64, expiresAt int64) int64 {
+	if expiresAt != 0 {
+		return expiresAt
+	}
+	return dateAdded + cacheDefaultTTL
+}
+
+func stale(dateAdded int64, expiresAt int64, now int64) bool {
+	return now >= expiry(dateAdded, expiresAt)
+}
+
+// Brings forward the expiry of the entries of ref after a refresh at refreshedAt found changes,
+// which the TTL computed before the changes were stored did not account for
+func shortenTTL(kind string, ref string, refreshedAt int64) {
+	coll, err := cacheColl(kind)
+
+	if err != nil {
+		return
+	}
+
+	expiresAt := refreshedAt + entryTTL(context.Background(), kind, ref, 0, refreshedAt)
+
+	_, err = coll.UpdateMany(context.Background(),
+		bson.D{{Key: "id", Value: ref}},
+		bson.D{{Key: "$min", Value: bson.D{{Key: "expires_at", Value: expiresAt}}}})
+
+	if err != nil {
+		utils.Logger.Println("Could not update the TTL of " + kind + " cache " + ref + ": " + err.Error())
+	}
+}
@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	mh "usicalendar/mongo_connection_handler"
+	utils "usicalendar/utils"
+
+	ics "github.com/arran4/golang-ical"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	calendarEnd = "END:VCALENDAR"
+	// Bytes of a rejected body kept to tell what upstream served instead
+	rejectedSample = 512
+)
+
+// Downloads the calendar of a cache entry and checks it before it is cached.
+// Bodies that are too large, of the wrong content type or not a well formed calendar
+// are recorded in rejected_calendars and never reach the cache. Resources that are
+// missing or rejected are not requested again while their negative cache entry lives.
+func fetchCalendar(ctx context.Context, kind string, ref string, url string) (*string, error) {
+	if err := negativeLookup(ctx, kind, ref); err != nil {
+		return nil, err
+	}
+
+	rawCal, err := utils.GetCalendarRequest(ctx, &url)
+
+	if err == nil {
+		err = validateCalendar(rawCal)
+	}
+
+	if err != nil && (errors.Is(err, utils.ErrBodyTooLarge) || errors.Is(err, utils.ErrUnexpectedContent) || errors.Is(err, utils.ErrInvalidCalendar)) {
+		go recordRejection(kind, ref, url, rawCal, err)
+	}
+
+	if err != nil {
+		go recordNegative(kind, ref, url, err)
+		return nil, err
+	}
+
+	return rawCal, nil
+}
+
+// Parses the whole calendar, which must have a start for every event
+func validateCalendar(raw *string) error {
+	if !utils.IsCalendarValid(raw) {
+		return utils.Errorf(utils.ErrUpstream, utils.ErrInvalidCalendar, "missing BEGIN:VCALENDAR")
+	}
+
+	if !strings.HasSuffix(strings.TrimSpace(*raw), calendarEnd) {
+		return utils.Errorf(utils.ErrUpstream, utils.ErrInvalidCalendar, "missing %s, truncated body", calendarEnd)
+	}
+
+	calendar, err := ics.ParseCalendar(strings.NewReader(*raw))
+
+	if err != nil {
+		return utils.Errorf(utils.ErrUpstream, utils.ErrInvalidCalendar, "%s", err.Error())
+	}
+
+	for _, event := range calendar.Events() {
+		if event.GetProperty(ics.ComponentPropertyDtStart) == nil {
+			return utils.Errorf(utils.ErrUpstream, utils.ErrInvalidCalendar, "event %s has no start", event.Id())
+		}
+	}
+
+	return nil
+}
+
+func recordRejection(kind string, ref string, url string, raw *string, reason error) {
+	rejection := mh.RejectedCalendar{
+		ID:         primitive.NewObjectID(),
+		Kind:       kind,
+		Ref:        ref,
+		Url:        url,
+		Reason:     reason.Error(),
+		RejectedAt: time.Now().Unix(),
+	}
+
+	if raw != nil {
+		rejection.Size = len(*raw)
+		rejection.Sample = sample(*raw, rejectedSample)
+	}
+
+	utils.Logger.Println("Rejected " + kind + " calendar " + ref + ": " + rejection.Reason)
+
+	if _, err := mh.RejectedCalendarsColl.InsertOne(context.Background(), rejection); err != nil {
+		utils.Logger.Println("Could not record rejected " + kind + " calendar " + ref + ": " + err.Error())
+	}
+}
+
+// First n bytes of s, cut at a rune boundary
+func sample(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
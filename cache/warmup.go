@@ -0,0 +1,308 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	mh "usicalendar/mongo_connection_handler"
+	utils "usicalendar/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	warmUpWorkers = 4
+	// Errors kept in the status of a warm-up
+	warmUpMaxErrors = 20
+)
+
+var (
+	// Time between two scheduled warm-ups, WARMUP_INTERVAL_MS
+	warmUpInterval = utils.DurationFromEnv("WARMUP_INTERVAL_MS", 6*time.Hour)
+	// Delay of the first warm-up after startup, WARMUP_STARTUP_DELAY_MS
+	warmUpStartupDelay = utils.DurationFromEnv("WARMUP_STARTUP_DELAY_MS", 30*time.Second)
+	// Calendars fetched from search.usi.ch by one warm-up, WARMUP_MAX_FETCHES
+	warmUpBudget = utils.IntFromEnv("WARMUP_MAX_FETCHES", 500)
+	// Minimum time between two fetches of a warm-up, leaving most of the upstream rate limit
+	// to the requests of the users, WARMUP_FETCH_INTERVAL_MS
+	warmUpPace = utils.DurationFromEnv("WARMUP_FETCH_INTERVAL_MS", time.Second)
+)
+
+// Progress of the running or of the last cache warm-up. Fresh counts the calendars
+// that were cached already, Deferred the ones left for the next run once the budget was spent.
+type WarmUpStatus struct {
+	Running    bool     `json:"running"`
+	StartedAt  int64    `json:"started_at,omitempty"`
+	FinishedAt int64    `json:"finished_at,omitempty"`
+	Total      int      `json:"total"`
+	Fresh      int      `json:"fresh"`
+	Deferred   int      `json:"deferred"`
+	Done       int      `json:"done"`
+	Failed     int      `json:"failed"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// Calendar fetched by a warm-up: a course url or a subject id, with the last access
+// to the links that use it. url is a course url as one of the links stores it, which may
+// predate the canonical form ref and still key a cache entry.
+type warmUpTarget struct {
+	kind         string
+	ref          string
+	url          string
+	lastAccessed int64
+}
+
+var warmUp struct {
+	sync.Mutex
+	status WarmUpStatus
+}
+
+// Status of the running or of the last warm-up
+func WarmUpState() WarmUpStatus {
+	warmUp.Lock()
+	defer warmUp.Unlock()
+
+	status := warmUp.status
+	status.Errors = append([]string(nil), warmUp.status.Errors...)
+
+	return status
+}
+
+// Runs a warm-up shortly after startup and then every warmUpInterval, unless WARMUP_DISABLED=true
+func ScheduleWarmUp() {
+	if os.Getenv("WARMUP_DISABLED") == "true" {
+		return
+	}
+
+	time.Sleep(warmUpStartupDelay)
+
+	for {
+		if !StartWarmUp() {
+			utils.Logger.Println("Scheduled cache warm-up skipped, the previous one is still running")
+		}
+		time.Sleep(warmUpInterval)
+	}
+}
+
+// Fills the caches with the calendars of the existing links in the background, the calendars
+// of the most recently accessed links first. Calendars cached and fresh already are skipped,
+// at most warmUpBudget are fetched. False when a warm-up is already running.
+func StartWarmUp() bool {
+	warmUp.Lock()
+	defer warmUp.Unlock()
+
+	if warmUp.status.Running {
+		return false
+	}
+
+	warmUp.status = WarmUpStatus{Running: true, StartedAt: time.Now().Unix()}
+
+	go runWarmUp()
+
+	return true
+}
+
+func runWarmUp() {
+	targets, err := warmUpTargets(context.Background())
+
+	warmUp.Lock()
+	warmUp.status.Total = len(targets)
+	if err != nil {
+		utils.Logger.Println("Could not list the calendars to warm up: " + err.Error())
+		warmUp.status.Errors = append(warmUp.status.Errors, err.Error())
+	}
+	warmUp.Unlock()
+
+	queue := make(chan warmUpTarget)
+	var wg sync.WaitGroup
+
+	for i := 0; i < warmUpWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range queue {
+				warmUpOne(target)
+			}
+		}()
+	}
+
+	pace := time.NewTicker(warmUpPace)
+	fetched := 0
+
+	for _, target := range targets {
+		if !needsWarmUp(target) {
+			warmUp.Lock()
+			warmUp.status.Fresh++
+			warmUp.Unlock()
+			continue
+		}
+
+		if fetched >= warmUpBudget {
+			warmUp.Lock()
+			warmUp.status.Deferred++
+			warmUp.Unlock()
+			continue
+		}
+
+		<-pace.C
+		fetched++
+		queue <- target
+	}
+
+	pace.Stop()
+	close(queue)
+	wg.Wait()
+
+	warmUp.Lock()
+	warmUp.status.Running = false
+	warmUp.status.FinishedAt = time.Now().Unix()
+	status := warmUp.status
+	warmUp.Unlock()
+
+	utils.Logger.Printf("Cache warm-up done: %d calendars, %d fresh, %d fetched, %d failed, %d deferred\n",
+		status.Total, status.Fresh, status.Done, status.Failed, status.Deferred)
+}
+
+func warmUpOne(target warmUpTarget) {
+	ctx, cancel := context.WithTimeout(context.Background(), utils.RequestTimeout)
+	defer cancel()
+
+	var err error
+
+	if target.kind == mh.CacheKindCourse {
+		_, err = FetchCourseCalendar(ctx, &target.url)
+	} else {
+		_, err = FetchSubjectCalendar(ctx, &target.ref)
+	}
+
+	warmUp.Lock()
+	defer warmUp.Unlock()
+
+	warmUp.status.Done++
+
+	if err != nil {
+		warmUp.status.Failed++
+		if len(warmUp.status.Errors) < warmUpMaxErrors {
+			warmUp.status.Errors = append(warmUp.status.Errors, err.Error())
+		}
+	}
+}
+
+// Whether the calendar is missing from its cache or stale. When the cache cannot be read
+// the calendar is fetched, which reports the error.
+func needsWarmUp(target warmUpTarget) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), utils.DBTimeout)
+	defer cancel()
+
+	filter := bson.D{{Key: "id", Value: target.ref}}
+	coll := mh.SubjectCalendarCacheColl
+
+	if target.kind == mh.CacheKindCourse {
+		// same lookup as FetchCourseCalendar
+		filter = bson.D{{Key: "url", Value: bson.D{{Key: "$in", Value: bson.A{target.ref, target.url}}}}}
+		coll = mh.CourseCalendarCacheColl
+	}
+
+	var document struct {
+		DateAdded int64 `bson:"date_added"`
+		ExpiresAt int64 `bson:"expires_at"`
+	}
+
+	findOptions := options.FindOne().SetProjection(bson.D{{Key: "date_added", Value: 1}, {Key: "expires_at", Value: 1}})
+
+	if err := coll.FindOne(ctx, filter, findOptions).Decode(&document); err != nil {
+		return true
+	}
+
+	return stale(document.DateAdded, document.ExpiresAt, time.Now().Unix())
+}
+
+// Every course url and subject id used by a simple or complex link, the ones of the most
+// recently accessed links first
+func warmUpTargets(ctx context.Context) ([]warmUpTarget, error) {
+	type targetKey struct{ kind, ref string }
+	byKey := make(map[targetKey]*warmUpTarget)
+
+	add := func(kind string, ref string, url string, accessed int64) {
+		key := targetKey{kind, ref}
+		target, ok := byKey[key]
+		if !ok {
+			byKey[key] = &warmUpTarget{kind: kind, ref: ref, url: url, lastAccessed: accessed}
+			return
+		}
+		// the canonical url is looked up anyway, keep a legacy form if a link has one
+		if url != ref {
+			target.url = url
+		}
+		if accessed > target.lastAccessed {
+			target.lastAccessed = accessed
+		}
+	}
+
+	cursor, err := mh.ShortLinksColl.Find(ctx, bson.D{},
+		options.Find().SetProjection(bson.D{{Key: "url", Value: 1}, {Key: "last_accessed", Value: 1}}))
+
+	if err != nil {
+		return nil, mh.DBError(err, "short links")
+	}
+
+	for cursor.Next(ctx) {
+		var link mh.ShortLink
+		if err := cursor.Decode(&link); err == nil && link.Url != "" {
+			add(mh.CacheKindCourse, canonicalOrRaw(link.Url), link.Url, link.LastAccessed)
+		}
+	}
+
+	cursor.Close(ctx)
+
+	cursor, err = mh.ComplexShortLinksColl.Find(ctx, bson.D{},
+		options.Find().SetProjection(bson.D{
+			{Key: "has_base_calendar", Value: 1},
+			{Key: "url", Value: 1},
+			{Key: "extra_subjects", Value: 1},
+			{Key: "last_accessed", Value: 1},
+		}))
+
+	if err != nil {
+		return nil, mh.DBError(err, "complex short links")
+	}
+
+	for cursor.Next(ctx) {
+		var link mh.ComplexShortLink
+		if err := cursor.Decode(&link); err != nil {
+			continue
+		}
+		if link.HasBaseCalendar && link.Url != "" {
+			add(mh.CacheKindCourse, canonicalOrRaw(link.Url), link.Url, link.LastAccessed)
+		}
+		for _, subject := range link.ExtraSubjects {
+			add(mh.CacheKindSubject, subject, subject, link.LastAccessed)
+		}
+	}
+
+	cursor.Close(ctx)
+
+	targets := make([]warmUpTarget, 0, len(byKey))
+
+	for _, target := range byKey {
+		targets = append(targets, *target)
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].lastAccessed > targets[j].lastAccessed
+	})
+
+	return targets, nil
+}
+
+// Links created before the urls were canonicalised may store any form of the url
+func canonicalOrRaw(url string) string {
+	if canonical, err := utils.CanonicalCourseUrl(url); err == nil {
+		return canonical
+	}
+	return url
+}
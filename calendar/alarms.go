@@ -0,0 +1,83 @@
+package cal
+
+import (
+	"strconv"
+	"strings"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// Longest lead time accepted for a reminder (4 weeks)
+const MaxAlarmMinutes = 40320
+
+// Words that mark an event as an exam in the upstream summaries, descriptions and categories
+var examKeywords = []string{"exam", "esame", "examen", "prüfung", "pruefung"}
+
+// Reports whether an event is an exam rather than a lecture
+func IsExam(event *ics.VEvent) bool {
+	for _, property := range []ics.ComponentProperty{ics.ComponentPropertySummary, ics.ComponentPropertyCategories, ics.ComponentPropertyDescription} {
+		prop := event.GetProperty(property)
+		if prop == nil {
+			continue
+		}
+
+		value := strings.ToLower(prop.Value)
+		for _, keyword := range examKeywords {
+			if strings.Contains(value, keyword) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Events of the calendar that are exams. Read before the summaries are rewritten,
+// a nickname would hide the keywords of the upstream summary.
+func ExamEvents(calendar *ics.Calendar) map[*ics.VEvent]bool {
+	exams := make(map[*ics.VEvent]bool)
+
+	for _, event := range calendar.Events() {
+		if IsExam(event) {
+			exams[event] = true
+		}
+	}
+
+	return exams
+}
+
+// Adds a display alarm to every event of the calendar, described by the summary of the event.
+// lectureMinutes and examMinutes are the lead times of lectures and of the events in exams,
+// an exam falls back to lectureMinutes when examMinutes is 0 and events whose lead time is 0
+// get no alarm.
+func AddAlarms(calendar *ics.Calendar, lectureMinutes int, examMinutes int, exams map[*ics.VEvent]bool) {
+	if lectureMinutes <= 0 && examMinutes <= 0 {
+		return
+	}
+
+	for i := range calendar.Components {
+		event, ok := calendar.Components[i].(*ics.VEvent)
+		if !ok {
+			continue
+		}
+
+		minutes := lectureMinutes
+		if examMinutes > 0 && exams[event] {
+			minutes = examMinutes
+		}
+
+		if minutes <= 0 {
+			continue
+		}
+
+		description := "Reminder"
+		if summary := event.GetProperty(ics.ComponentPropertySummary); summary != nil {
+			description = summary.Value
+		}
+
+		alarm := event.AddAlarm()
+		alarm.SetAction(ics.ActionDisplay)
+		alarm.SetTrigger("-PT" + strconv.Itoa(minutes) + "M")
+		alarm.SetProperty(ics.ComponentPropertyDescription, description)
+	}
+}
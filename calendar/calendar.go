@@ -2,27 +2,35 @@ package cal
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"strings"
 
 	cache "usicalendar/cache"
+	utils "usicalendar/utils"
 
 	ics "github.com/arran4/golang-ical"
 )
 
-func GetAllSubjects(url *string) (*map[string]int, *ics.Calendar) {
+func GetAllSubjects(ctx context.Context, url *string) (*map[string]int, *ics.Calendar, error) {
+	return subjectsOf(cache.FetchCourseCalendar(ctx, url))
+}
+
+// Same as GetAllSubjects with the course calendar as it was at the given unix time
+func GetAllSubjectsAt(ctx context.Context, url *string, at int64) (*map[string]int, *ics.Calendar, error) {
+	return subjectsOf(cache.CourseCalendarAt(ctx, url, at))
+}
 
-	r := cache.FetchCourseCalendar(url)
+func subjectsOf(r *string, err error) (*map[string]int, *ics.Calendar, error) {
 
-	if r == nil {
-		return nil, nil
+	if err != nil {
+		return nil, nil, err
 	}
 
 	cal, calErr := ics.ParseCalendar(strings.NewReader(*r))
 
 	if calErr != nil {
-		// fmt.Println("Error")
-		return nil, nil
+		return nil, nil, utils.Errorf(utils.ErrUpstream, calErr, "parsing course calendar")
 	}
 
 	m := make(map[string]int)
@@ -44,7 +52,7 @@ func GetAllSubjects(url *string) (*map[string]int, *ics.Calendar) {
 		}
 	}
 
-	return &m, cal
+	return &m, cal, nil
 }
 
 func FilterCalendar(cal *ics.Calendar, oldMap *map[string]int, filter *[]string) *ics.Calendar {
@@ -150,7 +158,11 @@ func stripRawCal(rawCal *string) *string {
 	return &outputStr
 }
 
-func GetSubjCalFromIdx(idx *string) *string {
-	cal := cache.FetchSubjectCalendar(idx)
-	return cal
+func GetSubjCalFromIdx(ctx context.Context, idx *string) (*string, error) {
+	return cache.FetchSubjectCalendar(ctx, idx)
+}
+
+// Same as GetSubjCalFromIdx with the subject calendar as it was at the given unix time
+func GetSubjCalFromIdxAt(ctx context.Context, idx *string, at int64) (*string, error) {
+	return cache.SubjectCalendarAt(ctx, idx, at)
 }
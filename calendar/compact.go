@@ -0,0 +1,195 @@
+package cal
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// Largest gap, in weeks, bridged with EXDATEs when folding weekly events
+const compactMaxGapWeeks = 3
+
+// Properties that may differ between the events folded into a single recurring event
+var compactIgnoredProperties = map[string]bool{
+	string(ics.ComponentPropertyUniqueId):     true,
+	string(ics.ComponentPropertyDtstamp):      true,
+	string(ics.ComponentPropertyDtStart):      true,
+	string(ics.ComponentPropertyDtEnd):        true,
+	string(ics.ComponentPropertyCreated):      true,
+	string(ics.ComponentPropertyLastModified): true,
+	string(ics.ComponentPropertySequence):     true,
+}
+
+type compactCandidate struct {
+	index int
+	event *ics.VEvent
+	start time.Time
+}
+
+// Folds single events that repeat every week with the same content, time and duration
+// into one event with a weekly RRULE (and EXDATEs for the skipped weeks, e.g. holidays).
+// Events that already recur, override an occurrence or have sub-components are left alone.
+func Compact(calendar *ics.Calendar) {
+	groups := make(map[string][]compactCandidate)
+
+	for i := range calendar.Components {
+		event, ok := calendar.Components[i].(*ics.VEvent)
+		if !ok || len(event.Components) > 0 {
+			continue
+		}
+		if event.GetProperty(ics.ComponentPropertyRrule) != nil || event.GetProperty(ics.ComponentPropertyRdate) != nil ||
+			event.GetProperty(ics.ComponentPropertyExdate) != nil || event.GetProperty(ics.ComponentPropertyRecurrenceId) != nil {
+			continue
+		}
+
+		key, start, ok := compactKey(event)
+		if !ok {
+			continue
+		}
+
+		groups[key] = append(groups[key], compactCandidate{index: i, event: event, start: start})
+	}
+
+	removed := make(map[int]bool)
+
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].start.Before(group[j].start)
+		})
+
+		run := []compactCandidate{group[0]}
+		for _, candidate := range group[1:] {
+			if weeksBetween(run[len(run)-1].start, candidate.start) <= compactMaxGapWeeks {
+				run = append(run, candidate)
+				continue
+			}
+			foldRun(run, removed)
+			run = []compactCandidate{candidate}
+		}
+		foldRun(run, removed)
+	}
+
+	if len(removed) == 0 {
+		return
+	}
+
+	components := make([]ics.Component, 0, len(calendar.Components)-len(removed))
+	for i, component := range calendar.Components {
+		if !removed[i] {
+			components = append(components, component)
+		}
+	}
+	calendar.Components = components
+}
+
+// Events with the same key only differ by the week they happen in
+func compactKey(event *ics.VEvent) (string, time.Time, bool) {
+	dtStart := event.GetProperty(ics.ComponentPropertyDtStart)
+	if dtStart == nil {
+		return "", time.Time{}, false
+	}
+
+	start, err := event.GetStartAt()
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	end, err := event.GetEndAt()
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	var properties []string
+	for _, prop := range event.Properties {
+		if compactIgnoredProperties[prop.IANAToken] {
+			continue
+		}
+		properties = append(properties, prop.IANAToken+":"+prop.Value)
+	}
+	sort.Strings(properties)
+
+	var b strings.Builder
+	// start is in the time zone of DTSTART, which is also the one the RRULE is expanded in
+	b.WriteString(start.Weekday().String())
+	b.WriteString("|" + start.Format("15:04:05"))
+	b.WriteString("|" + end.Sub(start).String())
+	b.WriteString("|" + strings.Join(dtStart.ICalParameters["TZID"], ","))
+	b.WriteString("|" + strconv.FormatBool(len(dtStart.Value) == 8))
+	for _, p := range properties {
+		b.WriteString("|" + p)
+	}
+
+	return b.String(), start, true
+}
+
+// Whole weeks between two starts on the same weekday
+func weeksBetween(a time.Time, b time.Time) int {
+	dayA := time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	dayB := time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+	return int(dayB.Sub(dayA).Hours()) / (24 * 7)
+}
+
+// Turns the first event of the run into a weekly recurring event and marks the others as removed
+func foldRun(run []compactCandidate, removed map[int]bool) {
+	if len(run) < 2 {
+		return
+	}
+
+	master := run[0].event
+	dtStart := master.GetProperty(ics.ComponentPropertyDtStart)
+
+	weeks := weeksBetween(run[0].start, run[len(run)-1].start) + 1
+
+	present := make(map[int]bool, len(run))
+	for _, candidate := range run {
+		present[weeksBetween(run[0].start, candidate.start)] = true
+	}
+
+	var exdates []string
+	for week := 1; week < weeks; week++ {
+		if !present[week] {
+			exdates = append(exdates, formatLike(dtStart, shiftDays(run[0].start, 7*week)))
+		}
+	}
+
+	master.SetProperty(ics.ComponentPropertyRrule, "FREQ=WEEKLY;COUNT="+strconv.Itoa(weeks))
+
+	if len(exdates) > 0 {
+		params := map[string][]string{}
+		if tzid, ok := dtStart.ICalParameters["TZID"]; ok {
+			params["TZID"] = tzid
+		}
+		if len(dtStart.Value) == 8 {
+			params["VALUE"] = []string{"DATE"}
+		}
+		master.Properties = append(master.Properties, ics.IANAProperty{
+			BaseProperty: ics.BaseProperty{
+				IANAToken:      string(ics.ComponentPropertyExdate),
+				ICalParameters: params,
+				Value:          strings.Join(exdates, ","),
+			},
+		})
+	}
+
+	for _, candidate := range run[1:] {
+		removed[candidate.index] = true
+	}
+}
+
+// Formats t the same way as the value of prop: date, UTC or local date-time
+func formatLike(prop *ics.IANAProperty, t time.Time) string {
+	switch {
+	case len(prop.Value) == 8:
+		return t.Format("20060102")
+	case strings.HasSuffix(prop.Value, "Z"):
+		return t.UTC().Format("20060102T150405Z")
+	}
+	return t.In(propertyLocation(prop)).Format("20060102T150405")
+}
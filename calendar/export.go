@@ -0,0 +1,299 @@
+package cal
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+const (
+	EventTypeLecture = "lecture"
+	EventTypeExam    = "exam"
+)
+
+// Simplified representation of an event for clients that do not want to parse ICS
+type EventEntry struct {
+	Start       time.Time  `json:"start"`
+	End         *time.Time `json:"end,omitempty"`
+	AllDay      bool       `json:"all_day,omitempty"`
+	SubjectID   string     `json:"subject_id"`
+	SubjectName string     `json:"subject_name"`
+	Summary     string     `json:"summary"`
+	Location    string     `json:"location,omitempty"`
+	Type        string     `json:"type"`
+}
+
+// Lists the occurrences of the calendar events overlapping [from, to) sorted by start, a zero
+// from or to is replaced by the matching end of the Span of the calendar. SubjectName is left
+// empty, subject names are resolved by the caller.
+func EventList(calendar *ics.Calendar, from time.Time, to time.Time) []EventEntry {
+	if from.IsZero() || to.IsZero() {
+		first, last := Span(calendar)
+		if from.IsZero() {
+			from = first
+		}
+		if to.IsZero() {
+			// the last end itself is part of the span
+			to = last.Add(time.Second)
+		}
+	}
+
+	return OccurrenceEntries(calendar, from, to)
+}
+
+func eventEntry(event *ics.VEvent) (EventEntry, bool) {
+	var entry EventEntry
+
+	start, err := event.GetStartAt()
+	if err != nil {
+		return entry, false
+	}
+
+	entry.Start = start
+	entry.AllDay = isDateOnly(event.GetProperty(ics.ComponentPropertyDtStart))
+
+	if end, err := event.GetEndAt(); err == nil {
+		entry.End = &end
+	}
+
+	entry.SubjectID = SubjectOf(event)
+
+	if summary := event.GetProperty(ics.ComponentPropertySummary); summary != nil {
+		entry.Summary = summary.Value
+	}
+	if location := event.GetProperty(ics.ComponentPropertyLocation); location != nil {
+		entry.Location = location.Value
+	}
+
+	entry.Type = EventTypeLecture
+	if IsExam(event) {
+		entry.Type = EventTypeExam
+	}
+
+	return entry, true
+}
+
+func isDateOnly(prop *ics.IANAProperty) bool {
+	if prop == nil {
+		return false
+	}
+	if v, ok := prop.ICalParameters["VALUE"]; ok && len(v) == 1 && v[0] == "DATE" {
+		return true
+	}
+	return len(prop.Value) == 8
+}
+
+// Value types of the properties that are not text, see RFC 7265 section 3.4
+var jCalPropertyTypes = map[string]string{
+	"DTSTART":       "date-time",
+	"DTEND":         "date-time",
+	"DTSTAMP":       "date-time",
+	"DUE":           "date-time",
+	"COMPLETED":     "date-time",
+	"CREATED":       "date-time",
+	"LAST-MODIFIED": "date-time",
+	"RECURRENCE-ID": "date-time",
+	"EXDATE":        "date-time",
+	"RDATE":         "date-time",
+	"DURATION":      "duration",
+	"TRIGGER":       "duration",
+	"RRULE":         "recur",
+	"EXRULE":        "recur",
+	"URL":           "uri",
+	"TZURL":         "uri",
+	"ATTACH":        "uri",
+	"ORGANIZER":     "cal-address",
+	"ATTENDEE":      "cal-address",
+	"SEQUENCE":      "integer",
+	"PRIORITY":      "integer",
+	"REPEAT":        "integer",
+	"TZOFFSETFROM":  "utc-offset",
+	"TZOFFSETTO":    "utc-offset",
+	"GEO":           "float",
+}
+
+// Properties whose value is a comma separated list
+var jCalMultiValued = map[string]bool{
+	"EXDATE":     true,
+	"RDATE":      true,
+	"CATEGORIES": true,
+	"RESOURCES":  true,
+}
+
+// Serialises the calendar as jCal (RFC 7265)
+func ToJCal(calendar *ics.Calendar) ([]byte, error) {
+	properties := make([]interface{}, 0, len(calendar.CalendarProperties))
+
+	for _, p := range calendar.CalendarProperties {
+		properties = append(properties, jCalProperty(&p.BaseProperty))
+	}
+
+	components := make([]interface{}, 0, len(calendar.Components))
+
+	for _, component := range calendar.Components {
+		components = append(components, jCalComponent(component))
+	}
+
+	return json.Marshal([]interface{}{"vcalendar", properties, components})
+}
+
+func jCalComponent(component ics.Component) []interface{} {
+	var name string
+
+	switch c := component.(type) {
+	case *ics.VEvent:
+		name = "vevent"
+	case *ics.VTodo:
+		name = "vtodo"
+	case *ics.VJournal:
+		name = "vjournal"
+	case *ics.VBusy:
+		name = "vfreebusy"
+	case *ics.VTimezone:
+		name = "vtimezone"
+	case *ics.VAlarm:
+		name = "valarm"
+	case *ics.Standard:
+		name = "standard"
+	case *ics.Daylight:
+		name = "daylight"
+	case *ics.GeneralComponent:
+		name = strings.ToLower(c.Token)
+	}
+
+	props := component.UnknownPropertiesIANAProperties()
+	properties := make([]interface{}, 0, len(props))
+
+	for i := range props {
+		properties = append(properties, jCalProperty(&props[i].BaseProperty))
+	}
+
+	subComponents := component.SubComponents()
+	children := make([]interface{}, 0, len(subComponents))
+
+	for _, sub := range subComponents {
+		children = append(children, jCalComponent(sub))
+	}
+
+	return []interface{}{name, properties, children}
+}
+
+func jCalProperty(p *ics.BaseProperty) []interface{} {
+	params := map[string]interface{}{}
+	valueType := "text"
+
+	if t, ok := jCalPropertyTypes[p.IANAToken]; ok {
+		valueType = t
+	}
+
+	for k, v := range p.ICalParameters {
+		if k == "VALUE" {
+			if len(v) == 1 {
+				valueType = strings.ToLower(v[0])
+			}
+			continue
+		}
+		if len(v) == 1 {
+			params[strings.ToLower(k)] = v[0]
+		} else {
+			params[strings.ToLower(k)] = v
+		}
+	}
+
+	values := []string{p.Value}
+	if jCalMultiValued[p.IANAToken] {
+		values = strings.Split(p.Value, ",")
+	}
+
+	// date-time properties may carry plain dates without the VALUE parameter
+	if valueType == "date-time" && len(values[0]) == 8 {
+		valueType = "date"
+	}
+
+	result := []interface{}{strings.ToLower(p.IANAToken), params, valueType}
+
+	for _, v := range values {
+		result = append(result, jCalValue(valueType, v))
+	}
+
+	return result
+}
+
+func jCalValue(valueType string, v string) interface{} {
+	switch valueType {
+	case "date":
+		if len(v) == 8 {
+			return v[0:4] + "-" + v[4:6] + "-" + v[6:8]
+		}
+	case "date-time":
+		// 20060102T150405[Z] -> 2006-01-02T15:04:05[Z]
+		if len(v) >= 15 && v[8] == 'T' {
+			return v[0:4] + "-" + v[4:6] + "-" + v[6:8] + "T" + v[9:11] + ":" + v[11:13] + ":" + v[13:15] + v[15:]
+		}
+	case "utc-offset":
+		if len(v) >= 5 {
+			return v[0:3] + ":" + v[3:5]
+		}
+	case "integer":
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	case "float":
+		// GEO is a structured value of two floats
+		parts := strings.Split(v, ";")
+		floats := make([]float64, 0, len(parts))
+		for _, part := range parts {
+			f, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return v
+			}
+			floats = append(floats, f)
+		}
+		return floats
+	case "recur":
+		recur := map[string]interface{}{}
+		for _, part := range strings.Split(v, ";") {
+			kv := strings.SplitN(part, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			key := strings.ToLower(kv[0])
+			switch key {
+			case "count", "interval":
+				if n, err := strconv.Atoi(kv[1]); err == nil {
+					recur[key] = n
+					continue
+				}
+			case "until":
+				if len(kv[1]) == 8 {
+					recur[key] = jCalValue("date", kv[1])
+				} else {
+					recur[key] = jCalValue("date-time", kv[1])
+				}
+				continue
+			}
+			parts := strings.Split(kv[1], ",")
+			values := make([]interface{}, len(parts))
+			for i, part := range parts {
+				values[i] = part
+				// BYxxx rule parts other than BYDAY are numeric
+				if strings.HasPrefix(key, "by") && key != "byday" {
+					if n, err := strconv.Atoi(part); err == nil {
+						values[i] = n
+					}
+				}
+			}
+			if len(values) == 1 {
+				recur[key] = values[0]
+			} else {
+				recur[key] = values
+			}
+		}
+		return recur
+	}
+
+	return v
+}
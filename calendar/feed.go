@@ -0,0 +1,216 @@
+package cal
+
+import (
+	"encoding/xml"
+	"strings"
+	"time"
+
+	mh "usicalendar/mongo_connection_handler"
+)
+
+// Metadata of a feed of schedule changes, Self is the absolute url of the feed
+// and Link the absolute url of the calendar it is about
+type ChangeFeed struct {
+	Title string
+	Self  string
+	Link  string
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID       string    `xml:"id"`
+	Title    string    `xml:"title"`
+	Updated  string    `xml:"updated"`
+	Category *atomTerm `xml:"category,omitempty"`
+	Summary  atomText  `xml:"summary"`
+}
+
+type atomTerm struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssItem struct {
+	GUID        rssGUID `xml:"guid"`
+	Title       string  `xml:"title"`
+	Category    string  `xml:"category"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string   `xml:"version,attr"`
+	Channel struct {
+		Title         string    `xml:"title"`
+		Link          string    `xml:"link"`
+		Description   string    `xml:"description"`
+		LastBuildDate string    `xml:"lastBuildDate"`
+		Items         []rssItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+var changeTitles = map[string]string{
+	mh.ChangeAdded:       "Added",
+	mh.ChangeRemoved:     "Removed",
+	mh.ChangeMoved:       "Moved",
+	mh.ChangeRoomChanged: "Room changed",
+	mh.ChangeCancelled:   "Cancelled",
+	mh.ChangeRecurrence:  "Repetition changed",
+}
+
+// Renders the changes as an Atom feed (RFC 4287), times in the text are shown in loc
+func ChangesAtom(feed ChangeFeed, changes []mh.ScheduleChange, loc *time.Location) ([]byte, error) {
+	doc := atomFeed{
+		ID:      feed.Self,
+		Title:   feed.Title,
+		Updated: feedUpdated(changes).Format(time.RFC3339),
+		Author:  "usicalendar.me",
+		Links: []atomLink{
+			{Href: feed.Self, Rel: "self", Type: "application/atom+xml"},
+			{Href: feed.Link, Rel: "alternate", Type: "text/calendar"},
+		},
+	}
+
+	for i := range changes {
+		change := &changes[i]
+		doc.Entries = append(doc.Entries, atomEntry{
+			ID:       changeID(change),
+			Title:    changeTitle(change),
+			Updated:  time.Unix(change.DetectedAt, 0).UTC().Format(time.RFC3339),
+			Category: &atomTerm{Term: change.Change},
+			Summary:  atomText{Type: "text", Body: ChangeDescription(change, loc)},
+		})
+	}
+
+	return marshalFeed(doc)
+}
+
+// Renders the changes as an RSS 2.0 feed, times in the text are shown in loc
+func ChangesRSS(feed ChangeFeed, changes []mh.ScheduleChange, loc *time.Location) ([]byte, error) {
+	doc := rssFeed{Version: "2.0"}
+	doc.Channel.Title = feed.Title
+	doc.Channel.Link = feed.Link
+	doc.Channel.Description = "Schedule changes of " + feed.Title
+	doc.Channel.LastBuildDate = feedUpdated(changes).Format(time.RFC1123Z)
+
+	for i := range changes {
+		change := &changes[i]
+		doc.Channel.Items = append(doc.Channel.Items, rssItem{
+			GUID:        rssGUID{Value: changeID(change)},
+			Title:       changeTitle(change),
+			Category:    change.Change,
+			Description: ChangeDescription(change, loc),
+			PubDate:     time.Unix(change.DetectedAt, 0).UTC().Format(time.RFC1123Z),
+		})
+	}
+
+	return marshalFeed(doc)
+}
+
+// One line description of a change, e.g. "Moved from Mon 02.10.2023 10:30-12:15 to Tue 03.10.2023 08:30-10:15"
+func ChangeDescription(change *mh.ScheduleChange, loc *time.Location) string {
+	oldSlot := formatSlot(change.OldStart, change.OldEnd, change.OldLocation, loc)
+	newSlot := formatSlot(change.NewStart, change.NewEnd, change.NewLocation, loc)
+
+	switch change.Change {
+	case mh.ChangeAdded:
+		return "Added on " + newSlot
+	case mh.ChangeRemoved:
+		return "Removed from " + oldSlot
+	case mh.ChangeMoved:
+		return "Moved from " + oldSlot + " to " + newSlot
+	case mh.ChangeRoomChanged:
+		return "Room changed from " + orUnknown(change.OldLocation) + " to " + orUnknown(change.NewLocation) +
+			" on " + formatSlot(change.NewStart, change.NewEnd, "", loc)
+	case mh.ChangeCancelled:
+		return "Cancelled on " + oldSlot
+	case mh.ChangeRecurrence:
+		return "Repetition changed from " + recurrenceText(change.OldRecurrence) + " to " +
+			recurrenceText(change.NewRecurrence) + " for the series starting " + newSlot
+	}
+
+	return change.Change
+}
+
+func changeTitle(change *mh.ScheduleChange) string {
+	name := change.Summary
+	if name == "" {
+		name = change.Subject
+	}
+
+	if title, ok := changeTitles[change.Change]; ok {
+		return title + ": " + name
+	}
+	return name
+}
+
+func changeID(change *mh.ScheduleChange) string {
+	return "urn:usicalendar:change:" + change.ID.Hex()
+}
+
+func formatSlot(start int64, end int64, location string, loc *time.Location) string {
+	s := time.Unix(start, 0).In(loc)
+	slot := s.Format("Mon 02.01.2006 15:04")
+	if end > start {
+		slot += "-" + time.Unix(end, 0).In(loc).Format("15:04")
+	}
+	if location != "" {
+		slot += " in " + location
+	}
+	return slot
+}
+
+func orUnknown(location string) string {
+	if location == "" {
+		return "no room"
+	}
+	return location
+}
+
+func recurrenceText(recurrence string) string {
+	if recurrence == "" {
+		return "no repetition"
+	}
+	return strings.ReplaceAll(recurrence, "\n", "; ")
+}
+
+// Time of the most recent change, changes are sorted newest first
+func feedUpdated(changes []mh.ScheduleChange) time.Time {
+	if len(changes) == 0 {
+		return time.Now().UTC()
+	}
+	return time.Unix(changes[0].DetectedAt, 0).UTC()
+}
+
+func marshalFeed(doc interface{}) ([]byte, error) {
+	body, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
@@ -0,0 +1,156 @@
+package cal
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"usicalendar/utils"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+type Interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Parses a calendar produced by MergeRawCalendars (or any raw ICS body)
+func ParseRawCalendar(rawCal *string) *ics.Calendar {
+	if rawCal == nil {
+		return nil
+	}
+
+	calendar, err := ics.ParseCalendar(strings.NewReader(*rawCal))
+
+	if err != nil {
+		return nil
+	}
+
+	return calendar
+}
+
+// Returns the time taken by the occurrences of the calendar events, clipped to [from, to)
+func BusyIntervals(calendar *ics.Calendar, from time.Time, to time.Time) []Interval {
+	var busy []Interval
+
+	for _, occurrence := range Expand(calendar, from, to) {
+		start, end := occurrence.Start, occurrence.End
+
+		if !end.After(start) {
+			continue
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+
+		busy = append(busy, Interval{Start: start, End: end})
+	}
+
+	return busy
+}
+
+// Sorts and merges overlapping intervals
+func mergeIntervals(intervals []Interval) []Interval {
+	if len(intervals) == 0 {
+		return intervals
+	}
+
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].Start.Before(intervals[j].Start)
+	})
+
+	merged := []Interval{intervals[0]}
+
+	for _, in := range intervals[1:] {
+		last := &merged[len(merged)-1]
+		if in.Start.After(last.End) {
+			merged = append(merged, in)
+			continue
+		}
+		if in.End.After(last.End) {
+			last.End = in.End
+		}
+	}
+
+	return merged
+}
+
+// Computes the slots in [from, to) that fall inside the daily window [dayStart, dayEnd)
+// (offsets from midnight in loc) and are not covered by any busy interval.
+// Slots shorter than minDuration are dropped.
+func FreeSlots(busy []Interval, from time.Time, to time.Time, dayStart time.Duration, dayEnd time.Duration, minDuration time.Duration, loc *time.Location) []Interval {
+	busy = mergeIntervals(busy)
+
+	var free []Interval
+
+	from = from.In(loc)
+	day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+
+	for b := 0; day.Before(to); day = day.AddDate(0, 0, 1) {
+		// time.Date normalises the minutes, which keeps the window right on DST days
+		windowStart := time.Date(day.Year(), day.Month(), day.Day(), 0, int(dayStart.Minutes()), 0, 0, loc)
+		windowEnd := time.Date(day.Year(), day.Month(), day.Day(), 0, int(dayEnd.Minutes()), 0, 0, loc)
+
+		if windowStart.Before(from) {
+			windowStart = from
+		}
+		if windowEnd.After(to) {
+			windowEnd = to
+		}
+		if !windowStart.Before(windowEnd) {
+			continue
+		}
+
+		// skip busy intervals that end before this window
+		for b < len(busy) && !busy[b].End.After(windowStart) {
+			b++
+		}
+
+		cursor := windowStart
+		for i := b; i < len(busy) && busy[i].Start.Before(windowEnd); i++ {
+			if busy[i].Start.After(cursor) {
+				free = appendSlot(free, cursor, busy[i].Start, minDuration)
+			}
+			if busy[i].End.After(cursor) {
+				cursor = busy[i].End
+			}
+		}
+
+		if cursor.Before(windowEnd) {
+			free = appendSlot(free, cursor, windowEnd, minDuration)
+		}
+	}
+
+	return free
+}
+
+func appendSlot(slots []Interval, start time.Time, end time.Time, minDuration time.Duration) []Interval {
+	if end.Sub(start) < minDuration {
+		return slots
+	}
+	return append(slots, Interval{Start: start, End: end})
+}
+
+// Builds a calendar containing one "Free" event per slot
+func FreeSlotsCalendar(slots []Interval) *ics.Calendar {
+	calendar := ics.NewCalendar()
+	calendar.SetProductId("USI Search")
+	calendar.SetXWRCalName("Free time - usicalendar.me")
+
+	now := time.Now()
+
+	for _, slot := range slots {
+		event := calendar.AddEvent(utils.RandStringBytesMaskImprSrcSB(24) + "@usicalendar.me")
+		event.SetDtStampTime(now)
+		event.SetStartAt(slot.Start)
+		event.SetEndAt(slot.End)
+		event.SetSummary("Free")
+		event.SetProperty(ics.ComponentPropertyTransp, "TRANSPARENT")
+	}
+
+	return calendar
+}
@@ -0,0 +1,74 @@
+package cal
+
+import (
+	"strings"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+const (
+	MaxNameLength        = 100
+	MaxDescriptionLength = 500
+)
+
+const propertyXAppleCalendarColor = "X-APPLE-CALENDAR-COLOR"
+
+// Accepts "#RRGGBB" or "RRGGBB" and returns the colour as "#RRGGBB"
+func NormalizeColor(color string) (string, bool) {
+	color = strings.TrimPrefix(strings.TrimSpace(color), "#")
+
+	if len(color) != 6 {
+		return "", false
+	}
+
+	for _, c := range color {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') && !(c >= 'A' && c <= 'F') {
+			return "", false
+		}
+	}
+
+	return "#" + strings.ToUpper(color), true
+}
+
+// Sets the display name, description and colour of the calendar, empty values leave
+// whatever the calendar already has
+func SetCalendarInfo(calendar *ics.Calendar, name string, description string, color string) {
+	if name != "" {
+		setCalendarProperty(calendar, string(ics.PropertyXWRCalName), name)
+	}
+	if description != "" {
+		setCalendarProperty(calendar, string(ics.PropertyXWRCalDesc), description)
+	}
+	if color != "" {
+		setCalendarProperty(calendar, string(ics.PropertyColor), color)
+		setCalendarProperty(calendar, propertyXAppleCalendarColor, color)
+	}
+}
+
+// Replaces the value of a calendar property or adds it if it is missing
+func setCalendarProperty(calendar *ics.Calendar, name string, value string) {
+	for i := range calendar.CalendarProperties {
+		if calendar.CalendarProperties[i].IANAToken == name {
+			calendar.CalendarProperties[i].Value = value
+			return
+		}
+	}
+
+	calendar.CalendarProperties = append(calendar.CalendarProperties, ics.CalendarProperty{
+		BaseProperty: ics.BaseProperty{
+			IANAToken:      name,
+			ICalParameters: map[string][]string{},
+			Value:          value,
+		},
+	})
+}
+
+// Returns the display name of the calendar, empty if it has none
+func CalendarName(calendar *ics.Calendar) string {
+	for i := range calendar.CalendarProperties {
+		if calendar.CalendarProperties[i].IANAToken == string(ics.PropertyXWRCalName) {
+			return calendar.CalendarProperties[i].Value
+		}
+	}
+	return ""
+}
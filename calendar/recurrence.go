@@ -0,0 +1,552 @@
+package cal
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// Recurring events are never followed further than this from their first occurrence
+const recurrenceHorizon = 5 * 365 * 24 * time.Hour
+
+// Recurring events without UNTIL or COUNT are only followed this far by Span
+const unboundedRecurrenceSpan = 365 * 24 * time.Hour
+
+// Upper bound on the periods (days, weeks, months or years) walked by a single rule
+const maxRecurrencePeriods = 10000
+
+var icalWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// A concrete occurrence of an event
+type Occurrence struct {
+	Event *ics.VEvent
+	Start time.Time
+	End   time.Time
+}
+
+// BYDAY entry, ordinal is 0 when every matching weekday of the period is meant
+type weekdayNum struct {
+	ordinal int
+	weekday time.Weekday
+}
+
+// Subset of an RRULE (RFC 5545 section 3.3.10): FREQ, INTERVAL, COUNT, UNTIL, BYDAY,
+// BYMONTHDAY and BYMONTH. Rules using other parts are not expanded.
+type recurrence struct {
+	freq       string
+	interval   int
+	count      int
+	until      time.Time
+	byDay      []weekdayNum
+	byMonthDay []int
+	byMonth    []int
+}
+
+func parseRRule(value string, loc *time.Location) (*recurrence, bool) {
+	r := &recurrence{interval: 1}
+
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, false
+		}
+
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			r.freq = strings.ToUpper(kv[1])
+		case "INTERVAL":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 1 {
+				return nil, false
+			}
+			r.interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 1 {
+				return nil, false
+			}
+			r.count = n
+		case "UNTIL":
+			until, ok := parseICalTime(kv[1], loc)
+			if !ok {
+				return nil, false
+			}
+			r.until = until
+		case "BYDAY":
+			for _, day := range strings.Split(kv[1], ",") {
+				weekday, ok := icalWeekdays[strings.ToUpper(strings.TrimLeft(day, "+-0123456789"))]
+				if !ok {
+					return nil, false
+				}
+				var ordinal int
+				if prefix := day[:len(day)-2]; prefix != "" {
+					n, err := strconv.Atoi(prefix)
+					if err != nil || n == 0 {
+						return nil, false
+					}
+					ordinal = n
+				}
+				r.byDay = append(r.byDay, weekdayNum{ordinal: ordinal, weekday: weekday})
+			}
+		case "BYMONTHDAY":
+			for _, v := range strings.Split(kv[1], ",") {
+				n, err := strconv.Atoi(v)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return nil, false
+				}
+				r.byMonthDay = append(r.byMonthDay, n)
+			}
+		case "BYMONTH":
+			for _, v := range strings.Split(kv[1], ",") {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 1 || n > 12 {
+					return nil, false
+				}
+				r.byMonth = append(r.byMonth, n)
+			}
+		case "WKST":
+			// weeks always start on Monday
+		default:
+			return nil, false
+		}
+	}
+
+	switch r.freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+		return r, true
+	}
+
+	return nil, false
+}
+
+// Parses a DATE or DATE-TIME value, floating times are read in loc
+func parseICalTime(value string, loc *time.Location) (time.Time, bool) {
+	var t time.Time
+	var err error
+
+	switch {
+	case len(value) == 8:
+		t, err = time.ParseInLocation("20060102", value, loc)
+	case strings.HasSuffix(value, "Z"):
+		t, err = time.ParseInLocation("20060102T150405Z", value, time.UTC)
+	default:
+		t, err = time.ParseInLocation("20060102T150405", value, loc)
+	}
+
+	return t, err == nil
+}
+
+// Location of a property's TZID parameter, time.Local when missing or unknown
+func propertyLocation(prop *ics.IANAProperty) *time.Location {
+	if tzid, ok := prop.ICalParameters["TZID"]; ok && len(tzid) == 1 {
+		if loc, err := time.LoadLocation(tzid[0]); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// Returns the values of every occurrence of a (possibly repeated) date list property such as EXDATE or RDATE
+func dateList(event *ics.VEvent, property ics.ComponentProperty) []time.Time {
+	var dates []time.Time
+
+	for i := range event.Properties {
+		prop := &event.Properties[i]
+		if prop.IANAToken != string(property) {
+			continue
+		}
+
+		loc := propertyLocation(prop)
+
+		for _, value := range strings.Split(prop.Value, ",") {
+			if t, ok := parseICalTime(value, loc); ok {
+				dates = append(dates, t)
+			}
+		}
+	}
+
+	return dates
+}
+
+// Moves t by n days keeping its wall clock time across DST changes
+func shiftDays(t time.Time, n int) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day()+n, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// Days of the month selected by the rule, or the day of start when the rule selects none
+func (r *recurrence) monthDays(start time.Time, year int, month time.Month) []int {
+	n := daysIn(year, month)
+
+	if len(r.byMonthDay) == 0 && len(r.byDay) == 0 {
+		if start.Day() > n {
+			return nil
+		}
+		return []int{start.Day()}
+	}
+
+	selected := make(map[int]bool)
+
+	for _, d := range r.byMonthDay {
+		if d < 0 {
+			d = n + d + 1
+		}
+		if d >= 1 && d <= n {
+			selected[d] = true
+		}
+	}
+
+	firstWeekday := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC).Weekday()
+
+	for _, wd := range r.byDay {
+		var matching []int
+		for d := 1 + (int(wd.weekday)-int(firstWeekday)+7)%7; d <= n; d += 7 {
+			matching = append(matching, d)
+		}
+		switch {
+		case wd.ordinal > 0 && wd.ordinal <= len(matching):
+			selected[matching[wd.ordinal-1]] = true
+		case wd.ordinal < 0 && -wd.ordinal <= len(matching):
+			selected[matching[len(matching)+wd.ordinal]] = true
+		case wd.ordinal == 0:
+			for _, d := range matching {
+				selected[d] = true
+			}
+		}
+	}
+
+	// BYMONTHDAY and BYDAY together only keep the days matching both
+	if len(r.byMonthDay) > 0 && len(r.byDay) > 0 {
+		for d := range selected {
+			if !r.matchesWeekday(time.Date(year, month, d, 0, 0, 0, 0, time.UTC).Weekday()) {
+				delete(selected, d)
+			}
+		}
+	}
+
+	days := make([]int, 0, len(selected))
+	for d := range selected {
+		days = append(days, d)
+	}
+	sort.Ints(days)
+
+	return days
+}
+
+func (r *recurrence) matchesWeekday(weekday time.Weekday) bool {
+	for _, wd := range r.byDay {
+		if wd.weekday == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *recurrence) matchesMonth(month time.Month) bool {
+	if len(r.byMonth) == 0 {
+		return true
+	}
+	for _, m := range r.byMonth {
+		if time.Month(m) == month {
+			return true
+		}
+	}
+	return false
+}
+
+// Candidate starts of the period-th period of the rule, in order
+func (r *recurrence) candidates(start time.Time, period int) []time.Time {
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, start.Hour(), start.Minute(), start.Second(), start.Nanosecond(), start.Location())
+	}
+
+	var result []time.Time
+
+	switch r.freq {
+	case "DAILY":
+		t := shiftDays(start, period*r.interval)
+		if r.matchesMonth(t.Month()) && (len(r.byDay) == 0 || r.matchesWeekday(t.Weekday())) {
+			result = append(result, t)
+		}
+
+	case "WEEKLY":
+		if len(r.byDay) == 0 {
+			return []time.Time{shiftDays(start, 7*period*r.interval)}
+		}
+		// weeks start on Monday
+		monday := shiftDays(start, 7*period*r.interval-(int(start.Weekday())+6)%7)
+		for day := 0; day < 7; day++ {
+			t := shiftDays(monday, day)
+			if r.matchesWeekday(t.Weekday()) && r.matchesMonth(t.Month()) {
+				result = append(result, t)
+			}
+		}
+
+	case "MONTHLY":
+		first := time.Date(start.Year(), start.Month()+time.Month(period*r.interval), 1, 0, 0, 0, 0, time.UTC)
+		if !r.matchesMonth(first.Month()) {
+			return nil
+		}
+		for _, d := range r.monthDays(start, first.Year(), first.Month()) {
+			result = append(result, at(first.Year(), first.Month(), d))
+		}
+
+	case "YEARLY":
+		year := start.Year() + period*r.interval
+		months := []time.Month{start.Month()}
+		if len(r.byMonth) > 0 {
+			months = months[:0]
+			for m := 1; m <= 12; m++ {
+				if r.matchesMonth(time.Month(m)) {
+					months = append(months, time.Month(m))
+				}
+			}
+		}
+		for _, month := range months {
+			for _, d := range r.monthDays(start, year, month) {
+				result = append(result, at(year, month, d))
+			}
+		}
+	}
+
+	return result
+}
+
+// Returns the starts of the occurrences of the event up to limit, in order.
+// The RRULE is expanded from start, RDATEs are added and EXDATEs removed.
+func occurrenceStarts(event *ics.VEvent, start time.Time, limit time.Time) []time.Time {
+	if horizon := start.Add(recurrenceHorizon); limit.After(horizon) {
+		limit = horizon
+	}
+
+	starts := []time.Time{start}
+
+	if prop := event.GetProperty(ics.ComponentPropertyRrule); prop != nil {
+		if rule, ok := parseRRule(prop.Value, start.Location()); ok {
+			starts = rule.expand(start, limit)
+		}
+	}
+
+	starts = append(starts, dateList(event, ics.ComponentPropertyRdate)...)
+
+	excluded := make(map[int64]bool)
+	for _, t := range dateList(event, ics.ComponentPropertyExdate) {
+		excluded[t.Unix()] = true
+	}
+
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i].Before(starts[j])
+	})
+
+	result := starts[:0]
+	var previous int64
+
+	for i, t := range starts {
+		if excluded[t.Unix()] || t.After(limit) || (i > 0 && t.Unix() == previous) {
+			continue
+		}
+		previous = t.Unix()
+		result = append(result, t)
+	}
+
+	return result
+}
+
+func (r *recurrence) expand(start time.Time, limit time.Time) []time.Time {
+	// DTSTART is always the first occurrence
+	starts := []time.Time{start}
+	emitted := 1
+
+	for period := 0; period < maxRecurrencePeriods; period++ {
+		candidates := r.candidates(start, period)
+
+		for _, t := range candidates {
+			if !t.After(start) {
+				continue
+			}
+			if t.After(limit) || (!r.until.IsZero() && t.After(r.until)) || (r.count > 0 && emitted >= r.count) {
+				return starts
+			}
+			starts = append(starts, t)
+			emitted++
+		}
+	}
+
+	return starts
+}
+
+// Expands the events of the calendar into the occurrences overlapping [from, to).
+// Occurrences replaced by an event with a RECURRENCE-ID are skipped in favour of the replacement.
+func Expand(calendar *ics.Calendar, from time.Time, to time.Time) []Occurrence {
+	// UID -> replaced starts
+	overridden := make(map[string]map[int64]bool)
+
+	for i := range calendar.Components {
+		event, ok := calendar.Components[i].(*ics.VEvent)
+		if !ok {
+			continue
+		}
+		recurrenceId := event.GetProperty(ics.ComponentPropertyRecurrenceId)
+		if recurrenceId == nil {
+			continue
+		}
+		t, ok := parseICalTime(recurrenceId.Value, propertyLocation(recurrenceId))
+		if !ok {
+			continue
+		}
+		uid := event.Id()
+		if overridden[uid] == nil {
+			overridden[uid] = make(map[int64]bool)
+		}
+		overridden[uid][t.Unix()] = true
+	}
+
+	var occurrences []Occurrence
+
+	for i := range calendar.Components {
+		event, ok := calendar.Components[i].(*ics.VEvent)
+		if !ok {
+			continue
+		}
+
+		start, err := event.GetStartAt()
+		if err != nil {
+			continue
+		}
+
+		duration := time.Duration(0)
+		if end, err := event.GetEndAt(); err == nil {
+			duration = end.Sub(start)
+		}
+
+		replaced := overridden[event.Id()]
+		isOverride := event.GetProperty(ics.ComponentPropertyRecurrenceId) != nil
+
+		for _, t := range occurrenceStarts(event, start, to) {
+			if !isOverride && replaced[t.Unix()] {
+				continue
+			}
+			end := t.Add(duration)
+			if !end.After(from) && !(duration == 0 && !t.Before(from)) {
+				continue
+			}
+			if !t.Before(to) {
+				break
+			}
+			occurrences = append(occurrences, Occurrence{Event: event, Start: t, End: end})
+		}
+	}
+
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].Start.Before(occurrences[j].Start)
+	})
+
+	return occurrences
+}
+
+// Returns the first start and the last end of the events of the calendar. Recurring events are
+// followed until their UNTIL, their last occurrence when they have a COUNT, and at most
+// unboundedRecurrenceSpan after their first occurrence otherwise. Both are zero for a calendar
+// without events.
+func Span(calendar *ics.Calendar) (time.Time, time.Time) {
+	var first, last time.Time
+
+	for _, event := range calendar.Events() {
+		start, err := event.GetStartAt()
+		if err != nil {
+			continue
+		}
+
+		duration := time.Duration(0)
+		if end, err := event.GetEndAt(); err == nil {
+			duration = end.Sub(start)
+		}
+
+		limit := start.Add(recurrenceHorizon)
+
+		if prop := event.GetProperty(ics.ComponentPropertyRrule); prop != nil {
+			if rule, ok := parseRRule(prop.Value, start.Location()); ok && rule.until.IsZero() && rule.count == 0 {
+				limit = start.Add(unboundedRecurrenceSpan)
+			}
+		}
+
+		starts := occurrenceStarts(event, start, limit)
+
+		if len(starts) == 0 {
+			continue
+		}
+
+		if first.IsZero() || starts[0].Before(first) {
+			first = starts[0]
+		}
+		if end := starts[len(starts)-1].Add(duration); end.After(last) {
+			last = end
+		}
+	}
+
+	return first, last
+}
+
+// Expands the calendar like Expand and describes every occurrence as an EventEntry
+func OccurrenceEntries(calendar *ics.Calendar, from time.Time, to time.Time) []EventEntry {
+	entries := []EventEntry{}
+
+	for _, occurrence := range Expand(calendar, from, to) {
+		entry, ok := eventEntry(occurrence.Event)
+		if !ok {
+			continue
+		}
+
+		entry.Start = occurrence.Start
+		if entry.End != nil {
+			end := occurrence.End
+			entry.End = &end
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// First window expanded by Upcoming, doubled until enough occurrences are found
+const upcomingWindow = 28 * 24 * time.Hour
+
+// Returns the next count occurrences of the calendar events that have not ended before now.
+// The calendar is expanded in growing windows, so that a few upcoming events do not require
+// the expansion of every recurring event up to recurrenceHorizon.
+func Upcoming(calendar *ics.Calendar, now time.Time, count int) []EventEntry {
+	var upcoming []EventEntry
+
+	for window := upcomingWindow; ; window *= 2 {
+		if window > recurrenceHorizon {
+			window = recurrenceHorizon
+		}
+
+		upcoming = OccurrenceEntries(calendar, now, now.Add(window))
+
+		if len(upcoming) >= count || window == recurrenceHorizon {
+			break
+		}
+	}
+
+	if len(upcoming) > count {
+		upcoming = upcoming[:count]
+	}
+
+	return upcoming
+}
@@ -0,0 +1,163 @@
+package cal
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"strconv"
+	"time"
+)
+
+// Columns available in the spreadsheet exports
+var SpreadsheetColumns = map[string]bool{
+	"date":         true,
+	"start":        true,
+	"end":          true,
+	"start_time":   true,
+	"end_time":     true,
+	"all_day":      true,
+	"subject_id":   true,
+	"subject_name": true,
+	"summary":      true,
+	"location":     true,
+	"type":         true,
+}
+
+var DefaultSpreadsheetColumns = []string{"date", "start_time", "end_time", "subject_name", "summary", "location", "type"}
+
+func columnValue(e *EventEntry, column string, loc *time.Location) string {
+	switch column {
+	case "date":
+		return e.Start.In(loc).Format("2006-01-02")
+	case "start":
+		return e.Start.In(loc).Format(time.RFC3339)
+	case "end":
+		if e.End != nil {
+			return e.End.In(loc).Format(time.RFC3339)
+		}
+	case "start_time":
+		if !e.AllDay {
+			return e.Start.In(loc).Format("15:04")
+		}
+	case "end_time":
+		if e.End != nil && !e.AllDay {
+			return e.End.In(loc).Format("15:04")
+		}
+	case "all_day":
+		return strconv.FormatBool(e.AllDay)
+	case "subject_id":
+		return e.SubjectID
+	case "subject_name":
+		return e.SubjectName
+	case "summary":
+		return e.Summary
+	case "location":
+		return e.Location
+	case "type":
+		return e.Type
+	}
+	return ""
+}
+
+func spreadsheetRows(entries []EventEntry, columns []string, loc *time.Location) [][]string {
+	rows := make([][]string, 0, len(entries)+1)
+	rows = append(rows, columns)
+
+	for i := range entries {
+		row := make([]string, len(columns))
+		for j, column := range columns {
+			row[j] = columnValue(&entries[i], column, loc)
+		}
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// Renders the events as CSV with a header row, times are shown in loc
+func ToCSV(entries []EventEntry, columns []string, loc *time.Location) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := csv.NewWriter(&buf)
+
+	if err := w.WriteAll(spreadsheetRows(entries, columns, loc)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+	xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Schedule" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`
+)
+
+// Renders the events as a single sheet XLSX workbook with a header row.
+// Every cell is an inline string so that no shared string table is needed.
+func ToXLSX(entries []EventEntry, columns []string, loc *time.Location) ([]byte, error) {
+	var sheet bytes.Buffer
+
+	sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	sheet.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	for r, row := range spreadsheetRows(entries, columns, loc) {
+		sheet.WriteString(`<row r="` + strconv.Itoa(r+1) + `">`)
+		for c, value := range row {
+			sheet.WriteString(`<c r="` + xlsxColumnName(c) + strconv.Itoa(r+1) + `" t="inlineStr"><is><t xml:space="preserve">`)
+			if err := xml.EscapeText(&sheet, []byte(value)); err != nil {
+				return nil, err
+			}
+			sheet.WriteString(`</t></is></c>`)
+		}
+		sheet.WriteString(`</row>`)
+	}
+
+	sheet.WriteString(`</sheetData></worksheet>`)
+
+	var buf bytes.Buffer
+
+	w := zip.NewWriter(&buf)
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"[Content_Types].xml", []byte(xlsxContentTypes)},
+		{"_rels/.rels", []byte(xlsxRels)},
+		{"xl/workbook.xml", []byte(xlsxWorkbook)},
+		{"xl/_rels/workbook.xml.rels", []byte(xlsxWorkbookRels)},
+		{"xl/worksheets/sheet1.xml", sheet.Bytes()},
+	}
+
+	for _, file := range files {
+		f, err := w.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(file.data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// 0 -> A, 25 -> Z, 26 -> AA
+func xlsxColumnName(index int) string {
+	name := ""
+	for index++; index > 0; index = (index - 1) / 26 {
+		name = string(rune('A'+(index-1)%26)) + name
+	}
+	return name
+}
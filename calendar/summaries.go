@@ -0,0 +1,107 @@
+package cal
+
+import (
+	"sort"
+	"strings"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+const MaxDisplayLength = 50
+
+type SummaryRule struct {
+	Nickname string
+	Prefix   string
+	Suffix   string
+	Emoji    string
+}
+
+// Returns the identifier used for the subject of an event: its url or, for the few events
+// that do not have one, its summary
+func SubjectOf(event *ics.VEvent) string {
+	if url := event.GetProperty(ics.ComponentPropertyUrl); url != nil {
+		return url.Value
+	}
+	if summary := event.GetProperty(ics.ComponentPropertySummary); summary != nil {
+		return summary.Value
+	}
+	return ""
+}
+
+// Reports whether the event belongs to subject, which is either an identifier as returned
+// by SubjectOf or a numeric subject id appearing in the url of the event
+func MatchesSubject(event *ics.VEvent, subject string) bool {
+	if SubjectOf(event) == subject {
+		return true
+	}
+
+	url := event.GetProperty(ics.ComponentPropertyUrl)
+
+	return url != nil && (strings.Contains(url.Value, "/"+subject+"/") || strings.HasSuffix(url.Value, "/"+subject))
+}
+
+// Rewrites the summary of every event according to the rule of its subject and,
+// if appendRoom is set, appends the location of the event. The rule keyed by the exact
+// SubjectOf the event wins, otherwise the longest matching subject id does.
+func RewriteSummaries(calendar *ics.Calendar, rules map[string]SummaryRule, appendRoom bool) {
+	if len(rules) == 0 && !appendRoom {
+		return
+	}
+
+	subjects := make([]string, 0, len(rules))
+	for subject := range rules {
+		subjects = append(subjects, subject)
+	}
+
+	sort.Slice(subjects, func(i, j int) bool {
+		if len(subjects[i]) != len(subjects[j]) {
+			return len(subjects[i]) > len(subjects[j])
+		}
+		return subjects[i] < subjects[j]
+	})
+
+	for i := range calendar.Components {
+		event, ok := calendar.Components[i].(*ics.VEvent)
+		if !ok {
+			continue
+		}
+
+		var summary string
+		if prop := event.GetProperty(ics.ComponentPropertySummary); prop != nil {
+			summary = prop.Value
+		}
+
+		if rule, ok := rules[SubjectOf(event)]; ok {
+			summary = rule.apply(summary)
+		} else {
+			for _, subject := range subjects {
+				if MatchesSubject(event, subject) {
+					summary = rules[subject].apply(summary)
+					break
+				}
+			}
+		}
+
+		if appendRoom {
+			if location := event.GetProperty(ics.ComponentPropertyLocation); location != nil && location.Value != "" {
+				summary += " (" + location.Value + ")"
+			}
+		}
+
+		event.SetProperty(ics.ComponentPropertySummary, summary)
+	}
+}
+
+func (rule SummaryRule) apply(summary string) string {
+	if rule.Nickname != "" {
+		summary = rule.Nickname
+	}
+
+	summary = rule.Prefix + summary + rule.Suffix
+
+	if rule.Emoji != "" {
+		summary = rule.Emoji + " " + summary
+	}
+
+	return summary
+}
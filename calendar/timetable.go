@@ -0,0 +1,259 @@
+package cal
+
+import (
+	"bytes"
+	"hash/fnv"
+	"html"
+	"html/template"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	timetableHourHeight = 48
+	timetableDayWidth   = 150
+	timetableGutter     = 48
+	timetableHeader     = 32
+	timetableFirstHour  = 8
+	timetableLastHour   = 18
+)
+
+var timetablePalette = []string{
+	"#4E79A7", "#F28E2B", "#E15759", "#76B7B2", "#59A14F", "#EDC948",
+	"#B07AA1", "#FF9DA7", "#9C755F", "#BAB0AC", "#1F77B4", "#2CA02C",
+}
+
+type timetableBlock struct {
+	Day      int
+	Lane     int
+	Lanes    int
+	Start    time.Time
+	End      time.Time
+	Title    string
+	Location string
+	Color    string
+}
+
+// Weekly grid of the events of a calendar, see WeekTimetable
+type Timetable struct {
+	Monday    time.Time
+	Days      int
+	FirstHour int
+	LastHour  int
+	blocks    []timetableBlock
+}
+
+// Returns the Monday at midnight of the week containing day
+func WeekStart(day time.Time, loc *time.Location) time.Time {
+	day = day.In(loc)
+	offset := (int(day.Weekday()) + 6) % 7
+	return time.Date(day.Year(), day.Month(), day.Day()-offset, 0, 0, 0, 0, loc)
+}
+
+// Lays out the timed events of the week starting at monday (see WeekStart).
+// The grid shows Monday to Friday, extended to the weekend when it has events,
+// and at least the hours between 8:00 and 18:00.
+func WeekTimetable(entries []EventEntry, monday time.Time, loc *time.Location) *Timetable {
+	t := &Timetable{Monday: monday, Days: 5, FirstHour: timetableFirstHour, LastHour: timetableLastHour}
+
+	nextMonday := monday.AddDate(0, 0, 7)
+
+	// lanes[day] holds the end of the last block placed in each lane,
+	// entries are sorted by start so a lane is free once its end is reached
+	lanes := make([][]time.Time, 7)
+
+	for _, e := range entries {
+		if e.AllDay || e.End == nil {
+			continue
+		}
+
+		start := e.Start.In(loc)
+		end := e.End.In(loc)
+
+		if !start.Before(nextMonday) || start.Before(monday) {
+			continue
+		}
+
+		day := (int(start.Weekday()) + 6) % 7
+
+		if day >= t.Days {
+			t.Days = day + 1
+		}
+		if start.Hour() < t.FirstHour {
+			t.FirstHour = start.Hour()
+		}
+		lastHour := end.Hour()
+		if end.Minute() > 0 {
+			lastHour++
+		}
+		if end.Day() != start.Day() {
+			lastHour = 24
+		}
+		if lastHour > t.LastHour {
+			t.LastHour = lastHour
+		}
+
+		lane := 0
+		for lane < len(lanes[day]) && lanes[day][lane].After(start) {
+			lane++
+		}
+		if lane == len(lanes[day]) {
+			lanes[day] = append(lanes[day], end)
+		} else {
+			lanes[day][lane] = end
+		}
+
+		title := e.Summary
+		if title == "" {
+			title = e.SubjectName
+		}
+
+		t.blocks = append(t.blocks, timetableBlock{
+			Day:      day,
+			Lane:     lane,
+			Start:    start,
+			End:      end,
+			Title:    title,
+			Location: e.Location,
+			Color:    SubjectColor(e.SubjectID),
+		})
+	}
+
+	for i := range t.blocks {
+		t.blocks[i].Lanes = len(lanes[t.blocks[i].Day])
+	}
+
+	return t
+}
+
+// Picks a stable colour for a subject
+func SubjectColor(subject string) string {
+	h := fnv.New32a()
+	h.Write([]byte(subject))
+	return timetablePalette[h.Sum32()%uint32(len(timetablePalette))]
+}
+
+// Renders the timetable as a standalone SVG document
+func (t *Timetable) SVG() string {
+	var b strings.Builder
+
+	width := timetableGutter + t.Days*timetableDayWidth
+	height := timetableHeader + (t.LastHour-t.FirstHour)*timetableHourHeight
+
+	b.WriteString(`<svg xmlns="http://www.w3.org/2000/svg" width="` + strconv.Itoa(width) + `" height="` + strconv.Itoa(height) +
+		`" viewBox="0 0 ` + strconv.Itoa(width) + ` ` + strconv.Itoa(height) + `" font-family="sans-serif" font-size="11">`)
+	b.WriteString(`<rect width="100%" height="100%" fill="#FFFFFF"/>`)
+
+	for d := 0; d < t.Days; d++ {
+		x := timetableGutter + d*timetableDayWidth
+		day := t.Monday.AddDate(0, 0, d)
+		b.WriteString(`<text x="` + strconv.Itoa(x+timetableDayWidth/2) + `" y="20" text-anchor="middle" font-weight="bold">` +
+			day.Format("Mon 02.01") + `</text>`)
+		b.WriteString(`<line x1="` + strconv.Itoa(x) + `" y1="0" x2="` + strconv.Itoa(x) + `" y2="` + strconv.Itoa(height) + `" stroke="#CCCCCC"/>`)
+	}
+
+	for h := t.FirstHour; h <= t.LastHour; h++ {
+		y := timetableHeader + (h-t.FirstHour)*timetableHourHeight
+		b.WriteString(`<line x1="` + strconv.Itoa(timetableGutter) + `" y1="` + strconv.Itoa(y) + `" x2="` + strconv.Itoa(width) +
+			`" y2="` + strconv.Itoa(y) + `" stroke="#E5E5E5"/>`)
+		if h < t.LastHour {
+			b.WriteString(`<text x="4" y="` + strconv.Itoa(y+12) + `" fill="#666666">` + strconv.Itoa(h) + `:00</text>`)
+		}
+	}
+
+	for _, block := range t.blocks {
+		laneWidth := (timetableDayWidth - 4) / block.Lanes
+		x := timetableGutter + block.Day*timetableDayWidth + 2 + block.Lane*laneWidth
+		y := timetableHeader + t.offset(block.Start)
+		h := t.offset(block.End) - t.offset(block.Start)
+		if block.End.Day() != block.Start.Day() {
+			h = (t.LastHour-t.FirstHour)*timetableHourHeight - t.offset(block.Start)
+		}
+		if h < 12 {
+			h = 12
+		}
+
+		label := html.EscapeString(block.Title)
+		times := block.Start.Format("15:04") + "–" + block.End.Format("15:04")
+
+		b.WriteString(`<g><title>` + label + ` ` + times + `</title>`)
+		b.WriteString(`<rect x="` + strconv.Itoa(x) + `" y="` + strconv.Itoa(y) + `" width="` + strconv.Itoa(laneWidth-2) +
+			`" height="` + strconv.Itoa(h) + `" rx="3" fill="` + block.Color + `" fill-opacity="0.85"/>`)
+		b.WriteString(`<svg x="` + strconv.Itoa(x+3) + `" y="` + strconv.Itoa(y) + `" width="` + strconv.Itoa(laneWidth-8) +
+			`" height="` + strconv.Itoa(h) + `"><text fill="#FFFFFF"><tspan x="0" dy="13" font-weight="bold">` + label +
+			`</tspan><tspan x="0" dy="13">` + times + `</tspan><tspan x="0" dy="13">` + html.EscapeString(block.Location) +
+			`</tspan></text></svg></g>`)
+	}
+
+	b.WriteString(`</svg>`)
+
+	return b.String()
+}
+
+// Vertical position in pixels of a time of the day
+func (t *Timetable) offset(at time.Time) int {
+	minutes := (at.Hour()-t.FirstHour)*60 + at.Minute()
+	return minutes * timetableHourHeight / 60
+}
+
+var timetablePage = template.Must(template.New("timetable").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}} - week of {{.Monday.Format "02.01.2006"}}</title>
+<style>
+body { font-family: sans-serif; margin: 16px; }
+nav { display: flex; gap: 16px; align-items: center; margin-bottom: 12px; }
+svg { max-width: 100%; height: auto; }
+@media print { nav { display: none; } body { margin: 0; } }
+</style>
+</head>
+<body>
+<nav>
+<a href="?{{.Previous}}">&larr; Previous week</a>
+<strong>{{.Title}} &middot; {{.Monday.Format "02.01.2006"}} &ndash; {{.Sunday.Format "02.01.2006"}}</strong>
+<a href="?{{.Next}}">Next week &rarr;</a>
+<a href="?{{.SVGLink}}">SVG</a>
+</nav>
+{{.Grid}}
+</body>
+</html>
+`))
+
+// Renders the timetable as an HTML page with links to the previous and next week.
+// query is the query of the page, kept by the week links with only week and format replaced.
+func (t *Timetable) HTML(title string, query url.Values) ([]byte, error) {
+	link := func(week time.Time, format string) string {
+		values := url.Values{}
+		for k, v := range query {
+			values[k] = append([]string(nil), v...)
+		}
+		values.Set("week", week.Format("2006-01-02"))
+		values.Del("format")
+		if format != "" {
+			values.Set("format", format)
+		}
+		return values.Encode()
+	}
+
+	var buf bytes.Buffer
+
+	err := timetablePage.Execute(&buf, map[string]interface{}{
+		"Title":    title,
+		"Monday":   t.Monday,
+		"Sunday":   t.Monday.AddDate(0, 0, 6),
+		"Previous": template.URL(link(t.Monday.AddDate(0, 0, -7), "")),
+		"Next":     template.URL(link(t.Monday.AddDate(0, 0, 7), "")),
+		"SVGLink":  template.URL(link(t.Monday, "svg")),
+		"Grid":     template.HTML(t.SVG()),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,123 @@
+package mongo
+
+import (
+	"context"
+	"regexp"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	mh "usicalendar/mongo_connection_handler"
+	utils "usicalendar/utils"
+)
+
+// Schedule changes detected since the given unix time, newest first.
+// course restricts the log to one course calendar, subject to the events of one subject
+// (a subject id or the identifier of the events), either one may be nil.
+func ScheduleChanges(ctx context.Context, course *string, subject *string, since int64, limit int64) ([]mh.ScheduleChange, error) {
+	filter := bson.D{{Key: "detected_at", Value: bson.D{{Key: "$gte", Value: since}}}}
+
+	if course != nil {
+		filter = append(filter,
+			bson.E{Key: "kind", Value: mh.CacheKindCourse},
+			bson.E{Key: "ref", Value: *course},
+		)
+	}
+
+	if subject != nil {
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "subject", Value: *subject}},
+			bson.D{{Key: "subject", Value: primitive.Regex{Pattern: "/" + regexp.QuoteMeta(*subject) + "(/|$)"}}},
+			bson.D{{Key: "kind", Value: mh.CacheKindSubject}, {Key: "ref", Value: *subject}},
+		}})
+	}
+
+	return findChanges(ctx, filter, limit)
+}
+
+// Schedule changes affecting the subjects of a simple link, newest first.
+// Also returns the options stored with the link.
+func ShortenedChanges(ctx context.Context, short *string, limit int64) ([]mh.ScheduleChange, *mh.LinkOptions, error) {
+	var result mh.ShortLink
+	err := mh.ShortLinksColl.FindOne(ctx, bson.D{{Key: "short_url", Value: *short}}).Decode(&result)
+
+	if err != nil {
+		return nil, nil, mh.DBError(err, "short link %s", *short)
+	}
+
+	filter := bson.D{{Key: "$or", Value: bson.A{courseChanges(&result.Url, result.Subjects)}}}
+
+	changes, err := findChanges(ctx, filter, limit)
+
+	return changes, result.Options, err
+}
+
+// Schedule changes affecting the base subjects and the extra subjects of a complex link, newest first.
+// Also returns the options stored with the link.
+func ComplexShortenedChanges(ctx context.Context, short *string, limit int64) ([]mh.ScheduleChange, *mh.LinkOptions, error) {
+	var result mh.ComplexShortLink
+	err := mh.ComplexShortLinksColl.FindOne(ctx, bson.D{{Key: "short_url", Value: *short}}).Decode(&result)
+
+	if err != nil {
+		return nil, nil, mh.DBError(err, "complex short link %s", *short)
+	}
+
+	alternatives := bson.A{bson.D{
+		{Key: "kind", Value: mh.CacheKindSubject},
+		{Key: "ref", Value: bson.D{{Key: "$in", Value: nonNil(result.ExtraSubjects)}}},
+	}}
+
+	if result.HasBaseCalendar {
+		alternatives = append(alternatives, courseChanges(&result.Url, result.BaseSubjects))
+	}
+
+	filter := bson.D{{Key: "$or", Value: alternatives}}
+
+	changes, err := findChanges(ctx, filter, limit)
+
+	return changes, result.Options, err
+}
+
+func courseChanges(url *string, subjects []string) bson.D {
+	return bson.D{
+		{Key: "kind", Value: mh.CacheKindCourse},
+		{Key: "ref", Value: courseID(url)},
+		{Key: "subject", Value: bson.D{{Key: "$in", Value: nonNil(subjects)}}},
+	}
+}
+
+// Id of the course calendar cache of a course url, see cache.FetchCourseCalendar
+func courseID(url *string) string {
+	if ref, err := utils.ParseCourseUrl(*url); err == nil {
+		return ref.ID
+	}
+	return ""
+}
+
+// $in does not accept null
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func findChanges(ctx context.Context, filter bson.D, limit int64) ([]mh.ScheduleChange, error) {
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "detected_at", Value: -1}, {Key: "new_start", Value: 1}}).SetLimit(limit)
+
+	cursor, err := mh.ScheduleChangesColl.Find(ctx, filter, findOptions)
+
+	if err != nil {
+		return nil, mh.DBError(err, "schedule changes")
+	}
+
+	changes := []mh.ScheduleChange{}
+
+	if err := cursor.All(ctx, &changes); err != nil {
+		return nil, mh.DBError(err, "schedule changes")
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,103 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	utils "usicalendar/utils"
+)
+
+// Extra subject calendars of a complex link fetched at the same time
+const maxParallelSubjectFetches = 4
+
+// Time given to the extra subject calendars of a complex link, SUBJECT_FETCH_TIMEOUT_MS
+var subjectFetchTimeout = utils.DurationFromEnv("SUBJECT_FETCH_TIMEOUT_MS", 20*time.Second)
+
+// Fetches the calendars of the subjects with at most maxParallelSubjectFetches requests at a time.
+// The calendars are returned in the order of ids, nil for the subjects that failed or were not
+// fetched before ctx was done or subjectFetchTimeout elapsed; those subjects are also listed apart
+// together with the error of the first of them that failed, or the timeout when they all ran out
+// of time. When ctx is cancelled, as when the client disconnects, its error is returned instead of
+// a timeout. Fetches still running when giving up are cancelled.
+func fetchSubjects(ctx context.Context, ids []string, fetch func(ctx context.Context, id *string) (*string, error)) ([]*string, []string, error) {
+	ctx, cancel := context.WithTimeout(ctx, subjectFetchTimeout)
+	defer cancel()
+
+	type fetched struct {
+		index int
+		raw   *string
+		err   error
+	}
+
+	// buffered so that late fetches never block once the results are no longer collected
+	results := make(chan fetched, len(ids))
+	slots := make(chan struct{}, maxParallelSubjectFetches)
+
+	for i := range ids {
+		go func(index int, id string) {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results <- fetched{index, nil, nil}
+				return
+			}
+			raw, err := fetch(ctx, &id)
+			<-slots
+			results <- fetched{index, raw, err}
+		}(i, ids[i])
+	}
+
+	rawCals := make([]*string, len(ids))
+	errs := make([]error, len(ids))
+
+collect:
+	for received := 0; received < len(ids); received++ {
+		select {
+		case r := <-results:
+			rawCals[r.index] = r.raw
+			errs[r.index] = r.err
+		case <-ctx.Done():
+			break collect
+		}
+	}
+
+	var failed []string
+	var firstErr, firstUnfetched error
+
+	for i, raw := range rawCals {
+		if raw != nil {
+			continue
+		}
+
+		failed = append(failed, ids[i])
+
+		err := errs[i]
+
+		switch {
+		case ctx.Err() != nil && (err == nil || errors.Is(err, ctx.Err())):
+			// not fetched in time, or no longer wanted by the caller
+			err = ctx.Err()
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = utils.Errorf(utils.ErrTimeout, err, "subject %s", ids[i])
+			}
+			if firstUnfetched == nil {
+				firstUnfetched = err
+			}
+			continue
+		case err == nil:
+			err = utils.Errorf(utils.ErrUpstream, nil, "subject %s returned no calendar", ids[i])
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// an upstream error says more than the timeout it may have caused
+	if firstErr == nil {
+		firstErr = firstUnfetched
+	}
+
+	return rawCals, failed, firstErr
+}
@@ -2,11 +2,14 @@ package mongo
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
@@ -19,128 +22,217 @@ import (
 
 var maxAttempts int = 200
 
-func FromShortened(short *string) *ics.Calendar {
+// Seconds between two writes of the last access time of a link
+const linkAccessResolution = 3600
+
+// Where the upstream calendars of a link are read from: the caches or the snapshot history
+type calendarSource struct {
+	course  func(ctx context.Context, url *string) (*map[string]int, *ics.Calendar, error)
+	subject func(ctx context.Context, id *string) (*string, error)
+}
+
+var cachedSource = calendarSource{course: cal.GetAllSubjects, subject: cal.GetSubjCalFromIdx}
+
+func snapshotSource(at int64) calendarSource {
+	return calendarSource{
+		course: func(ctx context.Context, url *string) (*map[string]int, *ics.Calendar, error) {
+			return cal.GetAllSubjectsAt(ctx, url, at)
+		},
+		subject: func(ctx context.Context, id *string) (*string, error) {
+			return cal.GetSubjCalFromIdxAt(ctx, id, at)
+		},
+	}
+}
+
+func FromShortened(ctx context.Context, short *string, overrides *mh.LinkOverrides) (*ics.Calendar, error) {
+	return fromShortened(ctx, short, overrides, cachedSource)
+}
+
+// Renders a simple link with the calendars as they were at the given unix time
+func FromShortenedAt(ctx context.Context, short *string, at int64, overrides *mh.LinkOverrides) (*ics.Calendar, error) {
+	return fromShortened(ctx, short, overrides, snapshotSource(at))
+}
+
+func fromShortened(ctx context.Context, short *string, overrides *mh.LinkOverrides, source calendarSource) (*ics.Calendar, error) {
 	var result *mh.ShortLink
-	var err = mh.ShortLinksColl.FindOne(context.Background(), bson.D{{Key: "short_url", Value: *short}}).Decode(&result)
+	var err = mh.ShortLinksColl.FindOne(ctx, bson.D{{Key: "short_url", Value: *short}}).Decode(&result)
 
 	if err != nil {
-		return nil
+		return nil, mh.DBError(err, "short link %s", *short)
 	}
 
-	subjects, calendar := cal.GetAllSubjects(&(*result).Url)
+	go touchLink(mh.ShortLinksColl, result.ID, result.LastAccessed)
+
+	subjects, calendar, err := source.course(ctx, &(*result).Url)
+
+	if err != nil {
+		return nil, err
+	}
 
 	calendar = cal.FilterCalendar(calendar, subjects, &(*result).Subjects)
 
-	return calendar
+	decorate(calendar, mergeLinkOptions(result.Options, overrides))
+
+	return calendar, nil
+}
+
+func FromComplexShortened(ctx context.Context, short *string, overrides *mh.LinkOverrides) (*ics.Calendar, error) {
+	calendar, _, err := fromComplexShortened(ctx, short, overrides, cachedSource)
+	return calendar, err
+}
+
+// Renders a complex link, giving up on the extra subject calendars not fetched before ctx is done.
+// Also returns the extra subjects left out of the calendar. It fails when the link does not exist,
+// when its base calendar is unavailable or when none of its extra subjects could be fetched.
+func FromComplexShortenedPartial(ctx context.Context, short *string, overrides *mh.LinkOverrides) (*ics.Calendar, []string, error) {
+	return fromComplexShortened(ctx, short, overrides, cachedSource)
+}
+
+// Renders a complex link with the calendars as they were at the given unix time
+func FromComplexShortenedAt(ctx context.Context, short *string, at int64, overrides *mh.LinkOverrides) (*ics.Calendar, error) {
+	calendar, _, err := fromComplexShortened(ctx, short, overrides, snapshotSource(at))
+	return calendar, err
 }
 
-func FromComplexShortened(short *string) *string {
+func fromComplexShortened(ctx context.Context, short *string, overrides *mh.LinkOverrides, source calendarSource) (*ics.Calendar, []string, error) {
 	var result *mh.ComplexShortLink
-	var err = mh.ComplexShortLinksColl.FindOne(context.Background(), bson.D{{Key: "short_url", Value: *short}}).Decode(&result)
+	var err = mh.ComplexShortLinksColl.FindOne(ctx, bson.D{{Key: "short_url", Value: *short}}).Decode(&result)
 
 	if err != nil {
-		return nil
+		return nil, nil, mh.DBError(err, "complex short link %s", *short)
+	}
+
+	go touchLink(mh.ComplexShortLinksColl, result.ID, result.LastAccessed)
+
+	// Fetch the extra subject calendars while the base calendar is generated
+	type extras struct {
+		rawCals []*string
+		failed  []string
+		err     error
 	}
+	extrasDone := make(chan extras, 1)
+
+	go func() {
+		rawCals, failed, err := fetchSubjects(ctx, result.ExtraSubjects, source.subject)
+		extrasDone <- extras{rawCals, failed, err}
+	}()
 
 	var baseCalendar *ics.Calendar
 	var subjects *map[string]int
 	var rawBaseCalendar string
 
-	var l int = len(result.ExtraSubjects)
-
 	// Generate base calendar
 	if result.HasBaseCalendar {
-		subjects, baseCalendar = cal.GetAllSubjects(&(*result).Url)
+		subjects, baseCalendar, err = source.course(ctx, &(*result).Url)
+		if err != nil {
+			return nil, nil, err
+		}
 		baseCalendar = cal.FilterCalendar(baseCalendar, subjects, &(*result).BaseSubjects)
 		rawBaseCalendar = baseCalendar.Serialize()
-		l++
 	}
 
-	rawCals := make([]*string, l)
+	fetched := <-extrasDone
+	rawCals := fetched.rawCals
 
 	if result.HasBaseCalendar {
-		rawCals[l-1] = &rawBaseCalendar
+		rawCals = append(rawCals, &rawBaseCalendar)
+	} else if len(result.ExtraSubjects) > 0 && len(fetched.failed) == len(result.ExtraSubjects) {
+		return nil, fetched.failed, fetched.err
 	}
 
-	// Get all extra subject calendars
-	for i, extra_subject := range result.ExtraSubjects {
-		raw := cal.GetSubjCalFromIdx(&extra_subject)
-		rawCals[i] = raw
+	calendar := cal.ParseRawCalendar(cal.MergeRawCalendars(rawCals))
+
+	if calendar == nil {
+		return nil, fetched.failed, utils.Errorf(utils.ErrUpstream, nil, "merging the calendars of %s", *short)
 	}
 
-	return cal.MergeRawCalendars(rawCals)
+	decorate(calendar, mergeLinkOptions(result.Options, overrides))
+
+	return calendar, fetched.failed, nil
 }
 
-func Shorten(url *string, filter *[]string) *string {
+// Records that a link was served, which the cache warm-up uses to prioritise its calendars.
+// Only written once the previous access is older than linkAccessResolution.
+func touchLink(coll *mongo.Collection, id primitive.ObjectID, lastAccessed int64) {
+	now := time.Now().Unix()
 
-	if len(*filter) == 0 {
-		return nil
+	if now-lastAccessed < linkAccessResolution {
+		return
 	}
 
-	subjects, _ := cal.GetAllSubjects(url)
+	if _, err := coll.UpdateByID(context.Background(), id, bson.D{{Key: "$set", Value: bson.D{{Key: "last_accessed", Value: now}}}}); err != nil {
+		utils.Logger.Println("Could not record access to link " + id.Hex() + ": " + err.Error())
+	}
+}
 
-	for _, f := range *filter {
-		if (*subjects)[f] != 1 {
-			return nil
-		} else {
-			if (*subjects)[f] > 1 {
-				return nil
-			}
-			(*subjects)[f]++
-		}
+// Resolves a short code that can either belong to a simple or to a complex link
+func FromAnyShortened(ctx context.Context, short *string) (*ics.Calendar, error) {
+	calendar, err := FromShortened(ctx, short, nil)
+
+	if !errors.Is(err, utils.ErrNotFound) {
+		return calendar, err
+	}
+
+	return FromComplexShortened(ctx, short, nil)
+}
+
+// Short link of the subjects filter of a course calendar. The url is stored in its canonical form
+// so that equivalent urls share the same link, links stored before keep the url they were created with.
+func Shorten(ctx context.Context, url *string, filter *[]string, linkOptions *mh.LinkOptions) (*string, error) {
+
+	canonical, err := utils.CanonicalCourseUrl(*url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	storedUrl := bson.D{{Key: "$in", Value: bson.A{canonical, *url}}}
+	url = &canonical
+
+	if err := checkFilter(ctx, url, filter); err != nil {
+		return nil, err
 	}
 
 	sort.Strings(*filter)
 
 	var result *mh.ShortLink
-	var err = mh.ShortLinksColl.FindOne(context.Background(),
-		bson.D{{Key: "url", Value: *url}, {Key: "subjects", Value: *filter}}).Decode(&result)
+	err = mh.ShortLinksColl.FindOne(ctx,
+		bson.D{{Key: "url", Value: storedUrl}, {Key: "subjects", Value: *filter}, {Key: "options", Value: linkOptions}}).Decode(&result)
 
 	if err != nil && err != mongo.ErrNoDocuments {
-		// SOMETHING IS WRONG IF THIS HAPPENS
-		return nil
+		return nil, mh.DBError(err, "short link of %s", *url)
 	}
 	if err == nil {
 		fmt.Println("Already shortened")
-		return &result.Short_url
+		return &result.Short_url, nil
 	}
 
-	var i int
-	var alphanum string
-	for i = 0; i < maxAttempts+1; i++ {
-		alphanum = utils.RandStringBytesMaskImprSrcSB(16)
-		e := mh.ShortLinksColl.FindOne(context.Background(), bson.D{{Key: "short_url", Value: alphanum}}).Err()
-		if e != nil {
-			if e == mongo.ErrNoDocuments {
-				break
-			} else {
-				return nil
-			}
-		}
-	}
+	alphanum, err := freeShortUrl(ctx, mh.ShortLinksColl)
 
-	if i == maxAttempts {
-		return nil
+	if err != nil {
+		return nil, err
 	}
 
-	res, err := mh.ShortLinksColl.InsertOne(context.Background(),
-		bson.D{{Key: "url", Value: *url}, {Key: "subjects", Value: *filter}, {Key: "short_url", Value: alphanum}})
+	document := bson.D{{Key: "url", Value: *url}, {Key: "subjects", Value: *filter}, {Key: "short_url", Value: alphanum}}
 
-	// && res.InsertedID != nil USELESS check
-	if err != nil || res.InsertedID == nil {
-		return nil
+	if linkOptions != nil {
+		document = append(document, bson.E{Key: "options", Value: linkOptions})
 	}
 
-	return &alphanum
+	if _, err := mh.ShortLinksColl.InsertOne(ctx, document); err != nil {
+		return nil, mh.DBError(err, "inserting short link of %s", *url)
+	}
+
+	return &alphanum, nil
 }
 
 // hasBaseCalendar indicates whether the complex calendar is composed of:
 // True: a combination of a base course + subjects
 // False: just subjects
-func ShortenComplex(hasBaseCalendar bool, url *string, baseFilter *[]string, extraSubjects *[]string) *string {
+func ShortenComplex(ctx context.Context, hasBaseCalendar bool, url *string, baseFilter *[]string, extraSubjects *[]string, linkOptions *mh.LinkOptions) (*string, error) {
 	// extra subjects are required for a complex calendar
 	if len(*extraSubjects) == 0 {
-		return nil
+		return nil, utils.Errorf(utils.ErrInvalidInput, nil, "no extra subjects")
 	}
 
 	sort.Strings(*extraSubjects)
@@ -148,41 +240,40 @@ func ShortenComplex(hasBaseCalendar bool, url *string, baseFilter *[]string, ext
 	// check for duplicate extra subjects
 	for i := 0; i < len(*extraSubjects)-1; i++ {
 		if (*extraSubjects)[i] == (*extraSubjects)[i+1] {
-			return nil
+			return nil, utils.Errorf(utils.ErrInvalidInput, nil, "duplicate extra subject %s", (*extraSubjects)[i])
 		}
 	}
 
 	// Check that all extra subjects exist
 	filter := bson.M{"subj_id": bson.M{"$in": *extraSubjects}}
-	count, err := mh.SubjectsColl.CountDocuments(context.Background(), filter)
+	count, err := mh.SubjectsColl.CountDocuments(ctx, filter)
 
 	if err != nil {
-		return nil
+		return nil, mh.DBError(err, "counting extra subjects")
 	}
 	if count != int64(len(*extraSubjects)) {
-		return nil
+		return nil, utils.Errorf(utils.ErrInvalidInput, nil, "unknown extra subjects")
 	}
 
 	// If this point is reached the request should be correctly constructed
 
+	var storedUrl interface{} = *url
+
 	// create base filtered calendar if requested
 	if hasBaseCalendar {
 
-		if len(*baseFilter) == 0 {
-			return nil
+		canonical, err := utils.CanonicalCourseUrl(*url)
+
+		if err != nil {
+			return nil, err
 		}
 
-		subjects, _ := cal.GetAllSubjects(url)
+		// links stored before the urls were canonicalised keep the url they were created with
+		storedUrl = bson.D{{Key: "$in", Value: bson.A{canonical, *url}}}
+		url = &canonical
 
-		for _, f := range *baseFilter {
-			if (*subjects)[f] != 1 {
-				return nil
-			} else {
-				if (*subjects)[f] > 1 {
-					return nil
-				}
-				(*subjects)[f]++
-			}
+		if err := checkFilter(ctx, url, baseFilter); err != nil {
+			return nil, err
 		}
 
 		sort.Strings(*baseFilter)
@@ -190,83 +281,96 @@ func ShortenComplex(hasBaseCalendar bool, url *string, baseFilter *[]string, ext
 	}
 
 	var result *mh.ComplexShortLink
-	err = mh.ComplexShortLinksColl.FindOne(context.Background(),
+	err = mh.ComplexShortLinksColl.FindOne(ctx,
 		bson.D{{Key: "has_base_calendar", Value: hasBaseCalendar},
-			{Key: "url", Value: *url},
+			{Key: "url", Value: storedUrl},
 			{Key: "base_subjects", Value: *baseFilter},
 			{Key: "extra_subjects", Value: *extraSubjects},
+			{Key: "options", Value: linkOptions},
 		}).Decode(&result)
 
 	if err != nil && err != mongo.ErrNoDocuments {
-		// SOMETHING IS WRONG IF THIS HAPPENS
-		return nil
+		return nil, mh.DBError(err, "complex short link of %s", *url)
 	}
 	if err == nil {
 		fmt.Println("Already shortened")
-		return &result.Short_url
+		return &result.Short_url, nil
 	}
 
-	var i int
-	var alphanum string
-	for i = 0; i < maxAttempts+1; i++ {
-		alphanum = utils.RandStringBytesMaskImprSrcSB(16)
-		e := mh.ComplexShortLinksColl.FindOne(context.Background(), bson.D{{Key: "short_url", Value: alphanum}}).Err()
-		if e != nil {
-			if e == mongo.ErrNoDocuments {
-				break
-			} else {
-				return nil
-			}
-		}
-	}
+	alphanum, err := freeShortUrl(ctx, mh.ComplexShortLinksColl)
 
-	if i == maxAttempts {
-		return nil
+	if err != nil {
+		return nil, err
 	}
 
-	res, err := mh.ComplexShortLinksColl.InsertOne(context.Background(),
-		bson.D{{Key: "has_base_calendar", Value: hasBaseCalendar},
-			{Key: "url", Value: *url},
-			{Key: "base_subjects", Value: *baseFilter},
-			{Key: "extra_subjects", Value: *extraSubjects},
-			{Key: "short_url", Value: alphanum}})
+	document := bson.D{{Key: "has_base_calendar", Value: hasBaseCalendar},
+		{Key: "url", Value: *url},
+		{Key: "base_subjects", Value: *baseFilter},
+		{Key: "extra_subjects", Value: *extraSubjects},
+		{Key: "short_url", Value: alphanum}}
+
+	if linkOptions != nil {
+		document = append(document, bson.E{Key: "options", Value: linkOptions})
+	}
 
-	// && res.InsertedID != nil USELESS check
-	if err != nil || res.InsertedID == nil {
-		return nil
+	if _, err := mh.ComplexShortLinksColl.InsertOne(ctx, document); err != nil {
+		return nil, mh.DBError(err, "inserting complex short link of %s", *url)
 	}
 
-	return &alphanum
+	return &alphanum, nil
 }
 
-func LatestCourses() *string {
-	// coursesColl := Db.Collection("courses")
-	findOptions := options.Find()
-	findOptions.SetSort(bson.D{{Key: "date_added", Value: -1}}).SetLimit(1)
+// Checks that filter is a non empty list of distinct subjects of the course calendar at url
+func checkFilter(ctx context.Context, url *string, filter *[]string) error {
+	if len(*filter) == 0 {
+		return utils.Errorf(utils.ErrInvalidInput, nil, "no subjects selected")
+	}
 
-	cursor, err := mh.CoursesColl.Find(context.Background(), bson.D{}, findOptions)
+	subjects, _, err := cal.GetAllSubjects(ctx, url)
 
 	if err != nil {
-		return nil
+		return err
 	}
 
-	// There can only be one element in the cursor.
-	var result mh.RawData
-	for cursor.Next(context.Background()) {
+	for _, f := range *filter {
+		if (*subjects)[f] != 1 {
+			return utils.Errorf(utils.ErrInvalidInput, nil, "%s is not a subject of %s or is repeated", f, *url)
+		}
+		(*subjects)[f]++
+	}
 
-		if err := cursor.Decode(&result); err != nil {
+	return nil
+}
 
-			return nil
+// Random short url not used yet in coll
+func freeShortUrl(ctx context.Context, coll *mongo.Collection) (string, error) {
+	for i := 0; i < maxAttempts+1; i++ {
+		alphanum := utils.RandStringBytesMaskImprSrcSB(16)
+		e := coll.FindOne(ctx, bson.D{{Key: "short_url", Value: alphanum}}).Err()
+		if e == mongo.ErrNoDocuments {
+			return alphanum, nil
+		}
+		if e != nil {
+			return "", mh.DBError(e, "looking up short url")
 		}
 	}
-	if err := cursor.Err(); err != nil {
-		return nil
+
+	return "", utils.Errorf(utils.ErrConflict, nil, "no free short url after %d attempts", maxAttempts)
+}
+
+func LatestCourses(ctx context.Context) (*string, error) {
+	var result mh.RawData
+	findOptions := options.FindOne()
+	findOptions.SetSort(bson.D{{Key: "date_added", Value: -1}})
+
+	if err := mh.CoursesColl.FindOne(ctx, bson.D{}, findOptions).Decode(&result); err != nil {
+		return nil, mh.DBError(err, "latest courses")
 	}
 
-	return &result.DataString
+	return &result.DataString, nil
 }
 
-func SubjIdToName(ids []string) []string {
+func SubjIdToName(ctx context.Context, ids []string) ([]string, error) {
 
 	// Make sure that the order in which the result will be returned is the same as in the array of ids
 	pipeline := mongo.Pipeline{
@@ -282,10 +386,9 @@ func SubjIdToName(ids []string) []string {
 	}
 
 	filter := bson.M{"subj_id": bson.M{"$in": ids}}
-	count, err := mh.SubjectsColl.CountDocuments(context.Background(), filter)
+	count, err := mh.SubjectsColl.CountDocuments(ctx, filter)
 	if err != nil {
-		fmt.Println(err)
-		return nil
+		return nil, mh.DBError(err, "counting subjects")
 	}
 
 	var result mh.Subject
@@ -297,10 +400,9 @@ func SubjIdToName(ids []string) []string {
 	// of the subject is used as its id. Not ideal
 	if count != int64(len(ids)) {
 		for i, id := range ids {
-			err := mh.SubjectsColl.FindOne(context.Background(), bson.D{{Key: "subj_id", Value: id}}).Decode(&result)
+			err := mh.SubjectsColl.FindOne(ctx, bson.D{{Key: "subj_id", Value: id}}).Decode(&result)
 			if err != nil && err != mongo.ErrNoDocuments {
-				fmt.Println(err)
-				return nil
+				return nil, mh.DBError(err, "subject %s", id)
 			}
 			if err == mongo.ErrNoDocuments {
 				subjectNames[i] = strings.Clone(ids[i])
@@ -311,47 +413,46 @@ func SubjIdToName(ids []string) []string {
 
 	} else {
 
-		cursor, err := mh.SubjectsColl.Aggregate(context.Background(), pipeline)
+		cursor, err := mh.SubjectsColl.Aggregate(ctx, pipeline)
 
 		if err != nil {
-			fmt.Println(err)
-			return nil
+			return nil, mh.DBError(err, "subject names")
 		}
 
 		var i int = 0
-		for cursor.Next(context.Background()) {
+		for cursor.Next(ctx) {
 			if err := cursor.Decode(&result); err != nil {
-				return nil
+				return nil, mh.DBError(err, "subject names")
 			}
 			subjectNames[i] = strings.Clone(result.SubjName)
 			i++
 		}
 	}
-	return subjectNames
+	return subjectNames, nil
 }
 
-func InfoCourse(id *string) (bool, *string, *string, []string) {
+func InfoCourse(ctx context.Context, id *string) (*string, *string, []string, error) {
 	var result mh.SubjectsAndCourse
-	err := mh.SubjectsAndCoursesColl.FindOne(context.Background(), bson.D{{Key: "id", Value: *id}}).Decode(&result)
+	err := mh.SubjectsAndCoursesColl.FindOne(ctx, bson.D{{Key: "id", Value: *id}}).Decode(&result)
 
 	if err != nil {
-		return true, nil, nil, nil
+		return nil, nil, nil, mh.DBError(err, "course %s", *id)
 	}
 
-	return false, &result.CID, &result.CourseName, result.Subjects
+	return &result.CID, &result.CourseName, result.Subjects, nil
 
 }
 
-func InfoAllCourses() *string {
+func InfoAllCourses(ctx context.Context) (*string, error) {
 	var result mh.RawData
 	findOptions := options.FindOne()
 	findOptions.SetSort(bson.D{{Key: "date_added", Value: -1}})
 
-	err := mh.SubjectsAndCoursesRawColl.FindOne(context.Background(), bson.D{}, findOptions).Decode(&result)
+	err := mh.SubjectsAndCoursesRawColl.FindOne(ctx, bson.D{}, findOptions).Decode(&result)
 
 	if err != nil {
-		return nil
+		return nil, mh.DBError(err, "courses and subjects")
 	}
 
-	return &result.DataString
+	return &result.DataString, nil
 }
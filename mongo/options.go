@@ -0,0 +1,38 @@
+package mongo
+
+import (
+	cal "usicalendar/calendar"
+	mh "usicalendar/mongo_connection_handler"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// Returns the options stored with a link with the set fields of overrides applied on top
+func mergeLinkOptions(stored *mh.LinkOptions, overrides *mh.LinkOverrides) mh.LinkOptions {
+	var options mh.LinkOptions
+
+	if stored != nil {
+		options = *stored
+	}
+
+	return overrides.Apply(options)
+}
+
+// Applies the link options to a filtered or merged calendar before it is served.
+// Summaries are rewritten before the alarms are added so that reminders show the served summary.
+func decorate(calendar *ics.Calendar, options mh.LinkOptions) {
+	if options.Compact {
+		cal.Compact(calendar)
+	}
+
+	exams := cal.ExamEvents(calendar)
+
+	rules := make(map[string]cal.SummaryRule, len(options.Display))
+	for _, d := range options.Display {
+		rules[d.Subject] = cal.SummaryRule{Nickname: d.Nickname, Prefix: d.Prefix, Suffix: d.Suffix, Emoji: d.Emoji}
+	}
+
+	cal.RewriteSummaries(calendar, rules, options.AppendRoom)
+	cal.AddAlarms(calendar, options.AlarmMinutes, options.ExamAlarmMinutes, exams)
+	cal.SetCalendarInfo(calendar, options.Name, options.Description, options.Color)
+}
@@ -0,0 +1,164 @@
+package mongo
+
+import (
+	"context"
+	"crypto/subtle"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	mh "usicalendar/mongo_connection_handler"
+	utils "usicalendar/utils"
+	webhooks "usicalendar/webhooks"
+)
+
+const (
+	MaxWebhooksPerLink = 5
+	webhookDeliveryLog = 20
+	// Webhooks that may be registered on a link per registrationWindow, deleted ones included
+	MaxWebhookRegistrations = 10
+	registrationWindow      = 24 * 3600
+)
+
+// Registers a webhook for a simple or complex link and returns it with the token needed to manage it.
+// ErrConflict when the link has too many webhooks, ErrTooManyRequests when it got too many recently.
+func AddWebhook(ctx context.Context, short *string, complex bool, url *string) (*mh.Webhook, string, error) {
+	token := webhooks.NewSecret()
+
+	hook := mh.Webhook{
+		ID:        primitive.NewObjectID(),
+		ShortUrl:  *short,
+		Complex:   complex,
+		Url:       *url,
+		Secret:    webhooks.NewSecret(),
+		TokenHash: webhooks.HashToken(token),
+		DateAdded: time.Now().Unix(),
+	}
+
+	if complex {
+		var link mh.ComplexShortLink
+		if err := mh.ComplexShortLinksColl.FindOne(ctx, bson.D{{Key: "short_url", Value: *short}}).Decode(&link); err != nil {
+			return nil, "", mh.DBError(err, "complex short link %s", *short)
+		}
+		if link.HasBaseCalendar {
+			hook.Course = courseID(&link.Url)
+			hook.Subjects = link.BaseSubjects
+		}
+		hook.ExtraSubjects = link.ExtraSubjects
+	} else {
+		var link mh.ShortLink
+		if err := mh.ShortLinksColl.FindOne(ctx, bson.D{{Key: "short_url", Value: *short}}).Decode(&link); err != nil {
+			return nil, "", mh.DBError(err, "short link %s", *short)
+		}
+		hook.Course = courseID(&link.Url)
+		hook.Subjects = link.Subjects
+	}
+
+	count, err := mh.WebhooksColl.CountDocuments(ctx, bson.D{{Key: "short_url", Value: *short}})
+
+	if err != nil {
+		return nil, "", mh.DBError(err, "webhooks of %s", *short)
+	}
+
+	if count >= MaxWebhooksPerLink {
+		return nil, "", utils.Errorf(utils.ErrConflict, nil, "%s has %d webhooks already", *short, count)
+	}
+
+	if err := recordRegistration(ctx, short, hook.DateAdded); err != nil {
+		return nil, "", err
+	}
+
+	if _, err := mh.WebhooksColl.InsertOne(ctx, hook); err != nil {
+		return nil, "", mh.DBError(err, "inserting webhook of %s", *short)
+	}
+
+	return &hook, token, nil
+}
+
+// Counts a new registration on a link, ErrTooManyRequests when the link got MaxWebhookRegistrations
+// in the last registrationWindow. Registering and deleting webhooks in a loop cannot flood a link.
+func recordRegistration(ctx context.Context, short *string, now int64) error {
+	mh.WebhookRegistrationsColl.DeleteMany(ctx, bson.D{
+		{Key: "short_url", Value: *short},
+		{Key: "date_added", Value: bson.D{{Key: "$lt", Value: now - registrationWindow}}},
+	})
+
+	count, err := mh.WebhookRegistrationsColl.CountDocuments(ctx, bson.D{{Key: "short_url", Value: *short}})
+
+	if err != nil {
+		return mh.DBError(err, "webhook registrations of %s", *short)
+	}
+
+	if count >= MaxWebhookRegistrations {
+		return utils.Errorf(utils.ErrTooManyRequests, nil, "%s got %d webhooks in the last day, try again later", *short, count)
+	}
+
+	registration := mh.WebhookRegistration{ID: primitive.NewObjectID(), ShortUrl: *short, DateAdded: now}
+
+	if _, err := mh.WebhookRegistrationsColl.InsertOne(ctx, registration); err != nil {
+		return mh.DBError(err, "recording webhook registration of %s", *short)
+	}
+
+	return nil
+}
+
+// Finds a webhook of a link, ErrNotFound unless token is the one returned when it was registered.
+// Webhooks registered before the tokens existed are managed with their secret.
+func FindWebhook(ctx context.Context, short *string, complex bool, id *string, token *string) (*mh.Webhook, error) {
+	objectID, err := primitive.ObjectIDFromHex(*id)
+
+	if err != nil {
+		return nil, utils.Errorf(utils.ErrNotFound, nil, "webhook %s", *id)
+	}
+
+	var hook mh.Webhook
+	err = mh.WebhooksColl.FindOne(ctx, bson.D{{Key: "_id", Value: objectID}, {Key: "short_url", Value: *short}}).Decode(&hook)
+
+	if err != nil {
+		return nil, mh.DBError(err, "webhook %s", *id)
+	}
+
+	expected, given := hook.TokenHash, webhooks.HashToken(*token)
+	if expected == "" {
+		expected, given = hook.Secret, *token
+	}
+
+	if hook.Complex != complex || subtle.ConstantTimeCompare([]byte(expected), []byte(given)) != 1 {
+		return nil, utils.Errorf(utils.ErrNotFound, nil, "webhook %s", *id)
+	}
+
+	return &hook, nil
+}
+
+// Most recent deliveries of a webhook, newest first
+func WebhookDeliveries(ctx context.Context, hook *mh.Webhook) ([]mh.WebhookDelivery, error) {
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "date_added", Value: -1}}).SetLimit(webhookDeliveryLog)
+
+	cursor, err := mh.WebhookDeliveriesColl.Find(ctx, bson.D{{Key: "webhook_id", Value: hook.ID}}, findOptions)
+
+	if err != nil {
+		return nil, mh.DBError(err, "deliveries of webhook %s", hook.ID.Hex())
+	}
+
+	deliveries := []mh.WebhookDelivery{}
+
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, mh.DBError(err, "deliveries of webhook %s", hook.ID.Hex())
+	}
+
+	return deliveries, nil
+}
+
+// Removes a webhook and its delivery log
+func DeleteWebhook(ctx context.Context, hook *mh.Webhook) error {
+	if _, err := mh.WebhooksColl.DeleteOne(ctx, bson.D{{Key: "_id", Value: hook.ID}}); err != nil {
+		return mh.DBError(err, "deleting webhook %s", hook.ID.Hex())
+	}
+
+	mh.WebhookDeliveriesColl.DeleteMany(ctx, bson.D{{Key: "webhook_id", Value: hook.ID}})
+
+	return nil
+}
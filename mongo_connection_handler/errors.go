@@ -0,0 +1,23 @@
+package mongo_connection_handler
+
+import (
+	"errors"
+
+	"usicalendar/utils"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Wraps the error of a database call in the matching utils error kind:
+// ErrNotFound for a missing document, ErrTimeout for an expired deadline, otherwise ErrDatabase
+func DBError(err error, format string, args ...interface{}) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return utils.Errorf(utils.ErrNotFound, nil, format, args...)
+	}
+
+	if mongo.IsTimeout(err) {
+		return utils.Errorf(utils.ErrTimeout, err, format, args...)
+	}
+
+	return utils.Errorf(utils.ClassifyError(err, utils.ErrDatabase), err, format, args...)
+}
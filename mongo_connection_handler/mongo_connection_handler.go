@@ -3,6 +3,7 @@ package mongo_connection_handler
 import (
 	"context"
 	"os"
+	"strconv"
 	"usicalendar/utils"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -30,13 +31,109 @@ var SubjectCalendarCacheColl *mongo.Collection
 
 var CoursesColl *mongo.Collection
 
+var ScheduleChangesColl *mongo.Collection
+
+var WebhooksColl *mongo.Collection
+
+var WebhookDeliveriesColl *mongo.Collection
+
+var WebhookRegistrationsColl *mongo.Collection
+
+var CalendarSnapshotsColl *mongo.Collection
+
+var CalendarBlobsColl *mongo.Collection
+
+var RejectedCalendarsColl *mongo.Collection
+
+var NegativeCacheColl *mongo.Collection
+
 const maxAttempts int = 2000
 
+// Rendering options stored with a link, nil when the link uses the defaults
+type LinkOptions struct {
+	// Lead time in minutes of the reminder added to every event, 0 for none
+	AlarmMinutes int `bson:"alarm_minutes,omitempty"`
+	// Lead time in minutes used for exams instead of AlarmMinutes, 0 to use AlarmMinutes
+	ExamAlarmMinutes int `bson:"exam_alarm_minutes,omitempty"`
+	// Calendar display name (X-WR-CALNAME)
+	Name string `bson:"name,omitempty"`
+	// Calendar description (X-WR-CALDESC)
+	Description string `bson:"description,omitempty"`
+	// Calendar colour as #RRGGBB (COLOR and X-APPLE-CALENDAR-COLOR)
+	Color string `bson:"color,omitempty"`
+	// Per-subject summary overrides, sorted by subject so that equal options compare equal
+	Display []SubjectDisplay `bson:"display,omitempty"`
+	// Appends the room of the event to its summary
+	AppendRoom bool `bson:"append_room,omitempty"`
+	// Folds weekly repeated events into recurring ones
+	Compact bool `bson:"compact,omitempty"`
+}
+
+// Link options given with a request, applied on top of the options stored with the link.
+// Every set field replaces the stored option, zero values included, so that alarm=0 turns off
+// a stored alarm and an empty name removes a stored one.
+type LinkOverrides struct {
+	AlarmMinutes     *int
+	ExamAlarmMinutes *int
+	Name             *string
+	Description      *string
+	Color            *string
+	Display          *[]SubjectDisplay
+	AppendRoom       *bool
+	Compact          *bool
+}
+
+// Options with the set fields of the overrides replaced
+func (o *LinkOverrides) Apply(options LinkOptions) LinkOptions {
+	if o == nil {
+		return options
+	}
+
+	if o.AlarmMinutes != nil {
+		options.AlarmMinutes = *o.AlarmMinutes
+	}
+	if o.ExamAlarmMinutes != nil {
+		options.ExamAlarmMinutes = *o.ExamAlarmMinutes
+	}
+	if o.Name != nil {
+		options.Name = *o.Name
+	}
+	if o.Description != nil {
+		options.Description = *o.Description
+	}
+	if o.Color != nil {
+		options.Color = *o.Color
+	}
+	if o.Display != nil {
+		options.Display = *o.Display
+	}
+	if o.AppendRoom != nil {
+		options.AppendRoom = *o.AppendRoom
+	}
+	if o.Compact != nil {
+		options.Compact = *o.Compact
+	}
+
+	return options
+}
+
+// How the events of a subject are titled in the served calendars
+type SubjectDisplay struct {
+	Subject  string `bson:"subject" json:"-"`
+	Nickname string `bson:"nickname,omitempty" json:"nickname,omitempty"`
+	Prefix   string `bson:"prefix,omitempty" json:"prefix,omitempty"`
+	Suffix   string `bson:"suffix,omitempty" json:"suffix,omitempty"`
+	Emoji    string `bson:"emoji,omitempty" json:"emoji,omitempty"`
+}
+
+// LastAccessed is the unix time the link was last served, updated at most once per hour
 type ShortLink struct {
-	ID        primitive.ObjectID `bson:"_id"`
-	Url       string             `bson:"url,omitempty"`
-	Subjects  []string           `bson:"subjects,omitempty"`
-	Short_url string             `bson:"short_url,omitempty"`
+	ID           primitive.ObjectID `bson:"_id"`
+	Url          string             `bson:"url,omitempty"`
+	Subjects     []string           `bson:"subjects,omitempty"`
+	Short_url    string             `bson:"short_url,omitempty"`
+	Options      *LinkOptions       `bson:"options,omitempty"`
+	LastAccessed int64              `bson:"last_accessed,omitempty"`
 }
 
 type RawData struct {
@@ -45,6 +142,7 @@ type RawData struct {
 	DataString string             `bson:"data,omitempty"`
 }
 
+// See ShortLink for LastAccessed
 type ComplexShortLink struct {
 	ID              primitive.ObjectID `bson:"_id"`
 	HasBaseCalendar bool               `bson:"has_base_calendar,omitempty"`
@@ -52,6 +150,8 @@ type ComplexShortLink struct {
 	BaseSubjects    []string           `bson:"base_subjects"`
 	ExtraSubjects   []string           `bson:"extra_subjects"`
 	Short_url       string             `bson:"short_url,omitempty"`
+	Options         *LinkOptions       `bson:"options,omitempty"`
+	LastAccessed    int64              `bson:"last_accessed,omitempty"`
 }
 
 type Subject struct {
@@ -67,19 +167,115 @@ type SubjectsAndCourse struct {
 	Subjects   []string           `bson:"subjects,omitempty"`
 }
 
+// Data is only set on documents written before the calendars were stored gzip compressed in DataGz,
+// Size is the length of the uncompressed calendar. LastError is the reason of the last failed refresh,
+// cleared by the next successful one. ExpiresAt is when the calendar is downloaded again, computed
+// per entry from its changes, 0 on documents cached before.
 type CourseCalendarCache struct {
-	ID        primitive.ObjectID `bson:"_id"`
-	Url       string             `bson:"url,omitempty"`
-	CID       string             `bson:"id,omitempty"`
-	Data      string             `bson:"data,omitempty"`
-	DateAdded int64              `bson:"date_added,omitempty"`
+	ID          primitive.ObjectID `bson:"_id"`
+	Url         string             `bson:"url,omitempty"`
+	CID         string             `bson:"id,omitempty"`
+	Data        string             `bson:"data,omitempty"`
+	DataGz      []byte             `bson:"data_gz,omitempty"`
+	Size        int                `bson:"size,omitempty"`
+	DateAdded   int64              `bson:"date_added,omitempty"`
+	LastError   string             `bson:"last_error,omitempty"`
+	LastErrorAt int64              `bson:"last_error_at,omitempty"`
+	ExpiresAt   int64              `bson:"expires_at,omitempty"`
 }
 
+// See CourseCalendarCache for Data, DataGz, LastError and ExpiresAt
 type SubjectCalendarCache struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	SID         string             `bson:"id,omitempty"`
+	Data        string             `bson:"data,omitempty"`
+	DataGz      []byte             `bson:"data_gz,omitempty"`
+	Size        int                `bson:"size,omitempty"`
+	DateAdded   int64              `bson:"date_added,omitempty"`
+	LastError   string             `bson:"last_error,omitempty"`
+	LastErrorAt int64              `bson:"last_error_at,omitempty"`
+	ExpiresAt   int64              `bson:"expires_at,omitempty"`
+}
+
+const (
+	CacheKindCourse  = "course"
+	CacheKindSubject = "subject"
+)
+
+// Version of a cached calendar, valid from ValidFrom until the next snapshot of the same entry.
+// Kind and Ref identify the cache entry as in ScheduleChange.
+type CalendarSnapshot struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Kind      string             `bson:"kind"`
+	Ref       string             `bson:"ref"`
+	Hash      string             `bson:"hash"`
+	ValidFrom int64              `bson:"valid_from"`
+}
+
+// Gzip compressed calendar shared by every snapshot with the same sha256 hash
+type CalendarBlob struct {
+	Hash string `bson:"_id"`
+	Data []byte `bson:"data"`
+	Size int    `bson:"size"`
+}
+
+// Upstream answer that was not cached because it is not a valid calendar.
+// Sample holds the beginning of the body, when there was one.
+type RejectedCalendar struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Kind       string             `bson:"kind"`
+	Ref        string             `bson:"ref"`
+	Url        string             `bson:"url"`
+	Reason     string             `bson:"reason"`
+	Size       int                `bson:"size,omitempty"`
+	Sample     string             `bson:"sample,omitempty"`
+	RejectedAt int64              `bson:"rejected_at"`
+}
+
+// Upstream resource that could not be cached, not requested again until ExpiresAt.
+// Status is the status of the upstream answer, 0 when the answer was rejected.
+type NegativeCacheEntry struct {
 	ID        primitive.ObjectID `bson:"_id"`
-	SID       string             `bson:"id,omitempty"`
-	Data      string             `bson:"data,omitempty"`
-	DateAdded int64              `bson:"date_added,omitempty"`
+	Kind      string             `bson:"kind"`
+	Ref       string             `bson:"ref"`
+	Url       string             `bson:"url"`
+	Status    int                `bson:"status,omitempty"`
+	Reason    string             `bson:"reason"`
+	DateAdded int64              `bson:"date_added"`
+	ExpiresAt int64              `bson:"expires_at"`
+}
+
+const (
+	ChangeAdded       = "added"
+	ChangeRemoved     = "removed"
+	ChangeMoved       = "moved"
+	ChangeRoomChanged = "room_changed"
+	ChangeCancelled   = "cancelled"
+	ChangeRecurrence  = "recurrence_changed"
+)
+
+// Event level difference found when a cached calendar is refreshed.
+// Ref is the course id for course calendars and the subject id for subject calendars,
+// Subject identifies the subject of the event as in the short links. OldRecurrence and
+// NewRecurrence hold the RRULE, RDATE and EXDATE lines of a recurring event, one per line.
+type ScheduleChange struct {
+	ID            primitive.ObjectID `bson:"_id" json:"-"`
+	Kind          string             `bson:"kind" json:"kind"`
+	Ref           string             `bson:"ref" json:"ref"`
+	Url           string             `bson:"url,omitempty" json:"url,omitempty"`
+	Subject       string             `bson:"subject" json:"subject"`
+	Change        string             `bson:"change" json:"change"`
+	UID           string             `bson:"uid,omitempty" json:"uid,omitempty"`
+	Summary       string             `bson:"summary,omitempty" json:"summary,omitempty"`
+	OldStart      int64              `bson:"old_start,omitempty" json:"old_start,omitempty"`
+	OldEnd        int64              `bson:"old_end,omitempty" json:"old_end,omitempty"`
+	NewStart      int64              `bson:"new_start,omitempty" json:"new_start,omitempty"`
+	NewEnd        int64              `bson:"new_end,omitempty" json:"new_end,omitempty"`
+	OldLocation   string             `bson:"old_location,omitempty" json:"old_location,omitempty"`
+	NewLocation   string             `bson:"new_location,omitempty" json:"new_location,omitempty"`
+	OldRecurrence string             `bson:"old_recurrence,omitempty" json:"old_recurrence,omitempty"`
+	NewRecurrence string             `bson:"new_recurrence,omitempty" json:"new_recurrence,omitempty"`
+	DetectedAt    int64              `bson:"detected_at" json:"detected_at"`
 }
 
 func connection() *mongo.Client {
@@ -97,7 +293,7 @@ func connection() *mongo.Client {
 	// ######################################
 
 	clientOptions := options.Client()
-	clientOptions.ApplyURI(os.Getenv("MONGO_CONNECTION_STRING") + "&timeoutMS=5000")
+	clientOptions.ApplyURI(os.Getenv("MONGO_CONNECTION_STRING") + "&timeoutMS=" + strconv.FormatInt(utils.DBTimeout.Milliseconds(), 10))
 
 	// Connect to MongoDB
 	client, err := mongo.Connect(context.TODO(), clientOptions)
@@ -129,7 +325,63 @@ func connection() *mongo.Client {
 
 	CoursesColl = Db.Collection("courses")
 
+	ScheduleChangesColl = Db.Collection("schedule_changes")
+
+	WebhooksColl = Db.Collection("webhooks")
+
+	WebhookDeliveriesColl = Db.Collection("webhook_deliveries")
+
+	WebhookRegistrationsColl = Db.Collection("webhook_registrations")
+
+	CalendarSnapshotsColl = Db.Collection("calendar_snapshots")
+
+	CalendarBlobsColl = Db.Collection("calendar_blobs")
+
+	RejectedCalendarsColl = Db.Collection("rejected_calendars")
+
+	NegativeCacheColl = Db.Collection("negative_cache")
+
 	utils.Logger.Println("Connected to MongoDB!")
 
 	return client
 }
+
+// Endpoint notified of the schedule changes of a link. The subjects of the link are copied
+// so that the webhooks affected by a cache refresh can be found without resolving every link.
+// Secret signs the payloads and is shared with the receiver, the token managing the webhook
+// is only known to whoever registered it and is stored hashed.
+type Webhook struct {
+	ID            primitive.ObjectID `bson:"_id" json:"id"`
+	ShortUrl      string             `bson:"short_url" json:"short_url"`
+	Complex       bool               `bson:"complex,omitempty" json:"complex"`
+	Url           string             `bson:"url" json:"url"`
+	Secret        string             `bson:"secret" json:"-"`
+	TokenHash     string             `bson:"token_hash,omitempty" json:"-"`
+	Course        string             `bson:"course,omitempty" json:"-"`
+	Subjects      []string           `bson:"subjects,omitempty" json:"-"`
+	ExtraSubjects []string           `bson:"extra_subjects,omitempty" json:"-"`
+	DateAdded     int64              `bson:"date_added" json:"date_added"`
+}
+
+// Registration of a webhook on a link, kept for a while to limit how often a link gets new webhooks
+type WebhookRegistration struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	ShortUrl  string             `bson:"short_url"`
+	DateAdded int64              `bson:"date_added"`
+}
+
+type WebhookAttempt struct {
+	At     int64  `bson:"at" json:"at"`
+	Status int    `bson:"status,omitempty" json:"status,omitempty"`
+	Error  string `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// One notification sent to a webhook, with every attempt made to deliver it
+type WebhookDelivery struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	WebhookID primitive.ObjectID `bson:"webhook_id" json:"-"`
+	Changes   int                `bson:"changes" json:"changes"`
+	Delivered bool               `bson:"delivered" json:"delivered"`
+	Attempts  []WebhookAttempt   `bson:"attempts" json:"attempts"`
+	DateAdded int64              `bson:"date_added" json:"date_added"`
+}
@@ -0,0 +1,142 @@
+package routes
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	cache "usicalendar/cache"
+	utils "usicalendar/utils"
+)
+
+const (
+	adminDefaultLimit = 100
+	adminMaxLimit     = 1000
+)
+
+// Entries of a cache with their age, size and last refresh error.
+// Query: kind=course|subject [skip=N] [limit=N]
+func GetCacheEntries(c *gin.Context) {
+
+	skip, err := strconv.ParseInt(c.DefaultQuery("skip", "0"), 10, 64)
+
+	if err != nil || skip < 0 {
+		badRequest(c, "skip must be a non negative number")
+		return
+	}
+
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", strconv.Itoa(adminDefaultLimit)), 10, 64)
+
+	if err != nil || limit < 1 || limit > adminMaxLimit {
+		badRequest(c, "limit must be between 1 and %d", adminMaxLimit)
+		return
+	}
+
+	entries, err := cache.ListEntries(c.Request.Context(), c.Query("kind"), skip, limit)
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	r, err := json.Marshal(map[string]interface{}{"entries": entries})
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Data(200, ContentTypeJSON, r)
+}
+
+// Query: url=<course calendar url>
+func PostRefreshCourse(c *gin.Context) {
+	var url string = c.Query("url")
+
+	if url == "" {
+		badRequest(c, "url is required")
+		return
+	}
+
+	rawCal, err := cache.RefreshCourseCalendar(c.Request.Context(), &url)
+
+	refreshed(c, rawCal, err)
+}
+
+func PostRefreshSubject(c *gin.Context) {
+	var id string = c.Param("id")
+
+	rawCal, err := cache.RefreshSubjectCalendar(c.Request.Context(), &id)
+
+	refreshed(c, rawCal, err)
+}
+
+func refreshed(c *gin.Context, rawCal *string, err error) {
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	r, err := json.Marshal(map[string]interface{}{"refreshed": true, "size": len(*rawCal)})
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Data(200, ContentTypeJSON, r)
+}
+
+// Query: url=<course calendar url>
+func DeleteCourseCache(c *gin.Context) {
+	var url string = c.Query("url")
+
+	if url == "" {
+		badRequest(c, "url is required")
+		return
+	}
+
+	if err := cache.PurgeCourseCalendar(c.Request.Context(), &url); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+func DeleteSubjectCache(c *gin.Context) {
+	var id string = c.Param("id")
+
+	if err := cache.PurgeSubjectCalendar(c.Request.Context(), &id); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+// Starts a warm-up of the calendars of the existing links, 409 when one is already running
+func PostWarmUp(c *gin.Context) {
+	if !cache.StartWarmUp() {
+		respondError(c, utils.Errorf(utils.ErrConflict, nil, "a warm-up is already running"))
+		return
+	}
+
+	warmUpStatus(c, 202)
+}
+
+func GetWarmUp(c *gin.Context) {
+	warmUpStatus(c, 200)
+}
+
+func warmUpStatus(c *gin.Context, status int) {
+	r, err := json.Marshal(cache.WarmUpState())
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Data(status, ContentTypeJSON, r)
+}
@@ -0,0 +1,86 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	cal "usicalendar/calendar"
+	mongo "usicalendar/mongo"
+	mh "usicalendar/mongo_connection_handler"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+const (
+	agendaDefaultCount = 5
+	agendaMaxCount     = 50
+)
+
+func GetNext(c *gin.Context) {
+	agenda(c, mongo.FromShortened)
+}
+
+func GetComplexNext(c *gin.Context) {
+	agenda(c, mongo.FromComplexShortened)
+}
+
+// Next events of a link starting from now.
+// Query: [count=N] [tz=Europe/Zurich]
+func agenda(c *gin.Context, render func(context.Context, *string, *mh.LinkOverrides) (*ics.Calendar, error)) {
+
+	setAccessControlHeader(c)
+
+	var short string = c.Param("shortened")
+
+	count, err := strconv.Atoi(c.DefaultQuery("count", strconv.Itoa(agendaDefaultCount)))
+
+	if err != nil || count < 1 || count > agendaMaxCount {
+		badRequest(c, "count must be between 1 and %d", agendaMaxCount)
+		return
+	}
+
+	loc, err := time.LoadLocation(c.DefaultQuery("tz", defaultTimezone))
+
+	if err != nil {
+		badRequest(c, "unknown time zone")
+		return
+	}
+
+	overrides, ok := linkOverridesFromQuery(c)
+
+	if !ok {
+		badRequest(c, "invalid link options")
+		return
+	}
+
+	calendar, err := render(c.Request.Context(), &short, overrides)
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	events := cal.Upcoming(calendar, time.Now(), count)
+	fillSubjectNames(c.Request.Context(), events)
+
+	for i := range events {
+		events[i].Start = events[i].Start.In(loc)
+		if events[i].End != nil {
+			end := events[i].End.In(loc)
+			events[i].End = &end
+		}
+	}
+
+	r, err := json.Marshal(map[string]interface{}{"events": events})
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Data(200, ContentTypeJSON, r)
+}
@@ -0,0 +1,66 @@
+package routes
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	mongo "usicalendar/mongo"
+)
+
+const (
+	changesDefaultLimit = 100
+	changesMaxLimit     = 500
+)
+
+// Change log of the cached calendars.
+// Query: course=<course id> and/or subject=<subject id> [since=<unix time>] [limit=N]
+func GetChanges(c *gin.Context) {
+
+	setAccessControlHeader(c)
+
+	var course, subject *string
+
+	if v := c.Query("course"); v != "" {
+		course = &v
+	}
+	if v := c.Query("subject"); v != "" {
+		subject = &v
+	}
+
+	if course == nil && subject == nil {
+		badRequest(c, "course or subject is required")
+		return
+	}
+
+	since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+
+	if err != nil || since < 0 {
+		badRequest(c, "since must be a unix time")
+		return
+	}
+
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", strconv.Itoa(changesDefaultLimit)), 10, 64)
+
+	if err != nil || limit < 1 || limit > changesMaxLimit {
+		badRequest(c, "limit must be between 1 and %d", changesMaxLimit)
+		return
+	}
+
+	changes, err := mongo.ScheduleChanges(c.Request.Context(), course, subject, since, limit)
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	r, err := json.Marshal(map[string]interface{}{"changes": changes})
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Data(200, ContentTypeJSON, r)
+}
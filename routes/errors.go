@@ -0,0 +1,65 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+
+	utils "usicalendar/utils"
+)
+
+// Status and code of the error responses of each error kind
+var errorStatuses = []struct {
+	kind   error
+	status int
+	code   string
+}{
+	{utils.ErrInvalidInput, 400, "invalid_input"},
+	{utils.ErrUnauthorized, 401, "unauthorized"},
+	{utils.ErrNotFound, 404, "not_found"},
+	{utils.ErrConflict, 409, "conflict"},
+	{utils.ErrTooManyRequests, 429, "too_many_requests"},
+	{utils.ErrTimeout, 504, "timeout"},
+	{utils.ErrUpstream, 502, "upstream_error"},
+	{utils.ErrDatabase, 503, "database_unavailable"},
+}
+
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Responds with the status matching the kind of err and a body {"error": {"code": ..., "message": ...}}.
+// The details of database and unexpected errors are only logged.
+func respondError(c *gin.Context, err error) {
+	status, code, message := 500, "internal_error", "internal error"
+
+	for _, e := range errorStatuses {
+		if errors.Is(err, e.kind) {
+			status, code, message = e.status, e.code, err.Error()
+			break
+		}
+	}
+
+	if status >= 500 {
+		utils.Logger.Println(c.Request.Method + " " + c.Request.URL.Path + ": " + err.Error())
+	}
+
+	if status == 500 || status == 503 {
+		message = "the request could not be completed, try again later"
+	}
+
+	r, _ := json.Marshal(errorResponse{Error: errorDetail{Code: code, Message: message}})
+
+	c.Data(status, ContentTypeJSON, r)
+}
+
+// Responds 400 describing the invalid parameter
+func badRequest(c *gin.Context, format string, args ...interface{}) {
+	respondError(c, utils.Errorf(utils.ErrInvalidInput, nil, format, args...))
+}
@@ -0,0 +1,109 @@
+package routes
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	cal "usicalendar/calendar"
+	mongo "usicalendar/mongo"
+	mh "usicalendar/mongo_connection_handler"
+)
+
+const (
+	ContentTypeAtom = "application/atom+xml; charset=utf-8"
+	ContentTypeRSS  = "application/rss+xml; charset=utf-8"
+)
+
+const (
+	feedDefaultLimit = 50
+	feedMaxLimit     = 200
+	feedDefaultTitle = "USI Calendar"
+)
+
+func GetChangesAtom(c *gin.Context) {
+	changesFeed(c, mongo.ShortenedChanges, cal.ChangesAtom, ContentTypeAtom)
+}
+
+func GetChangesRSS(c *gin.Context) {
+	changesFeed(c, mongo.ShortenedChanges, cal.ChangesRSS, ContentTypeRSS)
+}
+
+func GetComplexChangesAtom(c *gin.Context) {
+	changesFeed(c, mongo.ComplexShortenedChanges, cal.ChangesAtom, ContentTypeAtom)
+}
+
+func GetComplexChangesRSS(c *gin.Context) {
+	changesFeed(c, mongo.ComplexShortenedChanges, cal.ChangesRSS, ContentTypeRSS)
+}
+
+// Feed of the schedule changes affecting the subjects of a link.
+// Query: [limit=N] [tz=Europe/Zurich]
+func changesFeed(c *gin.Context,
+	find func(context.Context, *string, int64) ([]mh.ScheduleChange, *mh.LinkOptions, error),
+	render func(cal.ChangeFeed, []mh.ScheduleChange, *time.Location) ([]byte, error),
+	contentType string) {
+
+	setAccessControlHeader(c)
+
+	var short string = c.Param("shortened")
+
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", strconv.Itoa(feedDefaultLimit)), 10, 64)
+
+	if err != nil || limit < 1 || limit > feedMaxLimit {
+		badRequest(c, "limit must be between 1 and %d", feedMaxLimit)
+		return
+	}
+
+	loc, err := time.LoadLocation(c.DefaultQuery("tz", defaultTimezone))
+
+	if err != nil {
+		badRequest(c, "unknown time zone")
+		return
+	}
+
+	changes, linkOptions, err := find(c.Request.Context(), &short, limit)
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	title := feedDefaultTitle
+	if linkOptions != nil && linkOptions.Name != "" {
+		title = linkOptions.Name
+	}
+
+	base := requestBase(c)
+	path := c.Request.URL.Path
+
+	feed := cal.ChangeFeed{
+		Title: title,
+		Self:  base + path,
+		Link:  base + path[:strings.LastIndex(path, "/")],
+	}
+
+	r, err := render(feed, changes, loc)
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Data(200, contentType, r)
+}
+
+// Scheme and host the request was sent to, as seen by the client
+func requestBase(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
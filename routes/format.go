@@ -0,0 +1,277 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	cal "usicalendar/calendar"
+	mongo "usicalendar/mongo"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+const (
+	ContentTypeJCal = "application/calendar+json"
+	ContentTypeCSV  = "text/csv; charset=utf-8"
+	ContentTypeXLSX = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+)
+
+const (
+	FormatICS  = "ics"
+	FormatJCal = "jcal"
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+	FormatXLSX = "xlsx"
+)
+
+// Media types of the formats, the first one wins when the client weighs several the same
+var formatMediaTypes = []struct {
+	mediaType string
+	format    string
+}{
+	{ContentTypeCalendar, FormatICS},
+	{ContentTypeJCal, FormatJCal},
+	{"application/json", FormatJSON},
+	{"text/csv", FormatCSV},
+	{ContentTypeXLSX, FormatXLSX},
+}
+
+// Picks the output format from the format query parameter or, if missing, from the Accept header
+func requestedFormat(c *gin.Context) (string, bool) {
+	if format, ok := c.GetQuery("format"); ok {
+		switch format {
+		case FormatICS, FormatJCal, FormatJSON, FormatCSV, FormatXLSX:
+			return format, true
+		}
+		return "", false
+	}
+
+	return acceptedFormat(c.GetHeader("Accept")), true
+}
+
+// Format with the highest quality in an Accept header, FormatICS when none is acceptable
+func acceptedFormat(accept string) string {
+	ranges := parseAccept(accept)
+	format, best := FormatICS, 0.0
+
+	for _, candidate := range formatMediaTypes {
+		if q := mediaQuality(ranges, candidate.mediaType); q > best {
+			format, best = candidate.format, q
+		}
+	}
+
+	return format
+}
+
+type mediaRange struct {
+	mediaType string
+	quality   float64
+}
+
+// Media ranges of an Accept header with their q parameter, 1 when missing
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		r := mediaRange{mediaType: strings.ToLower(strings.TrimSpace(params[0])), quality: 1}
+
+		if r.mediaType == "" {
+			continue
+		}
+
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if q, err := strconv.ParseFloat(value, 64); err == nil && q >= 0 && q <= 1 {
+					r.quality = q
+				}
+			}
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	return ranges
+}
+
+// Quality of mediaType given by the most specific range matching it, 0 when none does
+func mediaQuality(ranges []mediaRange, mediaType string) float64 {
+	kind, _, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, 0
+
+	for _, r := range ranges {
+		var s int
+		switch r.mediaType {
+		case mediaType:
+			s = 3
+		case kind + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		default:
+			continue
+		}
+
+		if s > specificity {
+			quality, specificity = r.quality, s
+		}
+	}
+
+	return quality
+}
+
+// Writes the calendar in the format requested by the client
+func serveCalendar(c *gin.Context, calendar *ics.Calendar, format string) {
+	switch format {
+	case FormatJCal:
+		r, err := cal.ToJCal(calendar)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.Data(200, ContentTypeJCal, r)
+
+	case FormatJSON:
+		loc, err := time.LoadLocation(c.DefaultQuery("tz", defaultTimezone))
+		if err != nil {
+			badRequest(c, "unknown time zone")
+			return
+		}
+
+		from, to, ok := exportRange(c, loc)
+		if !ok {
+			return
+		}
+
+		events := cal.EventList(calendar, from, to)
+		fillSubjectNames(c.Request.Context(), events)
+
+		r, err := json.Marshal(map[string]interface{}{"events": events})
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.Data(200, ContentTypeJSON, r)
+
+	case FormatCSV, FormatXLSX:
+		serveSpreadsheet(c, calendar, format)
+
+	default:
+		c.Data(200, ContentTypeCalendar, []byte(calendar.Serialize()))
+	}
+}
+
+// Reads the optional from and to query parameters (YYYY-MM-DD, both included) bounding the
+// exported events, zero when missing. Responds 400 and returns false when they are invalid.
+func exportRange(c *gin.Context, loc *time.Location) (time.Time, time.Time, bool) {
+	var from, to time.Time
+	var err error
+
+	if v := c.Query("from"); v != "" {
+		if from, err = time.ParseInLocation("2006-01-02", v, loc); err != nil {
+			badRequest(c, "from must be a date as YYYY-MM-DD")
+			return from, to, false
+		}
+	}
+
+	if v := c.Query("to"); v != "" {
+		if to, err = time.ParseInLocation("2006-01-02", v, loc); err != nil {
+			badRequest(c, "to must be a date as YYYY-MM-DD")
+			return from, to, false
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+
+	if !from.IsZero() && !to.IsZero() && !to.After(from) {
+		badRequest(c, "to must not be before from")
+		return from, to, false
+	}
+
+	return from, to, true
+}
+
+func fillSubjectNames(ctx context.Context, events []cal.EventEntry) {
+	seen := make(map[string]int)
+	var ids []string
+
+	for _, e := range events {
+		if _, ok := seen[e.SubjectID]; !ok && e.SubjectID != "" {
+			seen[e.SubjectID] = len(ids)
+			ids = append(ids, e.SubjectID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return
+	}
+
+	// the subject names are optional, the events are served without them
+	names, err := mongo.SubjIdToName(ctx, ids)
+
+	if err != nil {
+		return
+	}
+
+	for i := range events {
+		if idx, ok := seen[events[i].SubjectID]; ok {
+			events[i].SubjectName = names[idx]
+		}
+	}
+}
+
+// Writes the events as CSV or XLSX.
+// Query: [columns=date~start_time~...] [tz=Europe/Zurich] [from=YYYY-MM-DD] [to=YYYY-MM-DD]
+func serveSpreadsheet(c *gin.Context, calendar *ics.Calendar, format string) {
+	columns := cal.DefaultSpreadsheetColumns
+
+	if columnsString := c.Query("columns"); columnsString != "" {
+		columns = strings.Split(columnsString, "~")
+		for _, column := range columns {
+			if !cal.SpreadsheetColumns[column] {
+				badRequest(c, "unknown column %s", column)
+				return
+			}
+		}
+	}
+
+	loc, err := time.LoadLocation(c.DefaultQuery("tz", defaultTimezone))
+
+	if err != nil {
+		badRequest(c, "unknown time zone")
+		return
+	}
+
+	from, to, ok := exportRange(c, loc)
+
+	if !ok {
+		return
+	}
+
+	events := cal.EventList(calendar, from, to)
+	fillSubjectNames(c.Request.Context(), events)
+
+	var r []byte
+	var contentType string
+
+	if format == FormatXLSX {
+		r, err = cal.ToXLSX(events, columns, loc)
+		contentType = ContentTypeXLSX
+	} else {
+		r, err = cal.ToCSV(events, columns, loc)
+		contentType = ContentTypeCSV
+	}
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="schedule.`+format+`"`)
+	c.Data(200, contentType, r)
+}
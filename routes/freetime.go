@@ -0,0 +1,146 @@
+package routes
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	cal "usicalendar/calendar"
+	mongo "usicalendar/mongo"
+)
+
+const (
+	defaultTimezone       = "Europe/Zurich"
+	freeTimeMaxLinks      = 10
+	freeTimeMaxDays       = 62
+	freeTimeDefaultDays   = 7
+	freeTimeDefaultStart  = "08:00"
+	freeTimeDefaultEnd    = "19:00"
+	freeTimeDefaultMinLen = 30
+)
+
+// Common free slots of several short links (simple or complex).
+// Query: links=a~b~c [from=YYYY-MM-DD] [to=YYYY-MM-DD] [day_start=HH:MM] [day_end=HH:MM, up to 24:00]
+// [min_duration=minutes] [tz=Europe/Zurich] [format=json|ics]
+func GetFreeTime(c *gin.Context) {
+
+	var linksString string = c.Query("links")
+
+	if linksString == "" {
+		badRequest(c, "links is required")
+		return
+	}
+
+	links := strings.Split(linksString, "~")
+
+	if len(links) > freeTimeMaxLinks {
+		badRequest(c, "at most %d links", freeTimeMaxLinks)
+		return
+	}
+
+	loc, err := time.LoadLocation(c.DefaultQuery("tz", defaultTimezone))
+
+	if err != nil {
+		badRequest(c, "unknown time zone")
+		return
+	}
+
+	now := time.Now().In(loc)
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+
+	if f := c.Query("from"); f != "" {
+		if from, err = time.ParseInLocation("2006-01-02", f, loc); err != nil {
+			badRequest(c, "from must be a date as YYYY-MM-DD")
+			return
+		}
+	}
+
+	to := from.AddDate(0, 0, freeTimeDefaultDays)
+
+	if t := c.Query("to"); t != "" {
+		if to, err = time.ParseInLocation("2006-01-02", t, loc); err != nil {
+			badRequest(c, "to must be a date as YYYY-MM-DD")
+			return
+		}
+		// the end date is inclusive
+		to = to.AddDate(0, 0, 1)
+	}
+
+	if !from.Before(to) || to.After(from.AddDate(0, 0, freeTimeMaxDays)) {
+		badRequest(c, "to must follow from by at most %d days", freeTimeMaxDays)
+		return
+	}
+
+	dayStart, ok1 := parseClock(c.DefaultQuery("day_start", freeTimeDefaultStart))
+	dayEnd, ok2 := parseClock(c.DefaultQuery("day_end", freeTimeDefaultEnd))
+
+	if !ok1 || !ok2 || dayStart >= dayEnd {
+		badRequest(c, "day_start and day_end must be HH:MM with day_start before day_end")
+		return
+	}
+
+	minDuration, err := strconv.Atoi(c.DefaultQuery("min_duration", strconv.Itoa(freeTimeDefaultMinLen)))
+
+	if err != nil || minDuration < 0 {
+		badRequest(c, "min_duration must be a number of minutes")
+		return
+	}
+
+	setAccessControlHeader(c)
+
+	var busy []cal.Interval
+
+	for i := range links {
+		calendar, err := mongo.FromAnyShortened(c.Request.Context(), &links[i])
+
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		busy = append(busy, cal.BusyIntervals(calendar, from, to)...)
+	}
+
+	slots := cal.FreeSlots(busy, from, to, dayStart, dayEnd, time.Duration(minDuration)*time.Minute, loc)
+
+	if c.Query("format") == "ics" {
+		c.Data(200, ContentTypeCalendar, []byte(cal.FreeSlotsCalendar(slots).Serialize()))
+		return
+	}
+
+	if slots == nil {
+		slots = []cal.Interval{}
+	}
+
+	for i := range slots {
+		slots[i].Start = slots[i].Start.In(loc)
+		slots[i].End = slots[i].End.In(loc)
+	}
+
+	r, err := json.Marshal(map[string]interface{}{"free": slots})
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Data(200, ContentTypeJSON, r)
+}
+
+// Parses HH:MM into an offset from midnight, 24:00 being the end of the day
+func parseClock(clock string) (time.Duration, bool) {
+	if clock == "24:00" {
+		return 24 * time.Hour, true
+	}
+
+	t, err := time.Parse("15:04", clock)
+
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, true
+}
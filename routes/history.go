@@ -0,0 +1,36 @@
+package routes
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reads the at query parameter used to render a link as it was at some point in time.
+// It is either an RFC 3339 time or a date, which stands for the end of that day in
+// the tz time zone. The first value is false when the parameter is missing.
+func requestedTime(c *gin.Context) (bool, int64, bool) {
+	at, ok := c.GetQuery("at")
+
+	if !ok {
+		return false, 0, true
+	}
+
+	if t, err := time.Parse(time.RFC3339, at); err == nil {
+		return true, t.Unix(), true
+	}
+
+	loc, err := time.LoadLocation(c.DefaultQuery("tz", defaultTimezone))
+
+	if err != nil {
+		return true, 0, false
+	}
+
+	day, err := time.ParseInLocation("2006-01-02", at, loc)
+
+	if err != nil {
+		return true, 0, false
+	}
+
+	return true, day.AddDate(0, 0, 1).Unix() - 1, true
+}
@@ -0,0 +1,49 @@
+package routes
+
+import (
+	"context"
+	"crypto/subtle"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	utils "usicalendar/utils"
+)
+
+// Bounds every request by utils.RequestTimeout. The request context is also
+// cancelled when the client disconnects, which stops the database and upstream calls.
+func RequestDeadline() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), utils.RequestTimeout)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// Token of the admin endpoints, ADMIN_TOKEN. The admin endpoints are disabled when it is unset.
+var adminToken = os.Getenv("ADMIN_TOKEN")
+
+// Lets a request through only with the header Authorization: Bearer <ADMIN_TOKEN>
+func AdminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminToken == "" {
+			respondError(c, utils.Errorf(utils.ErrUnauthorized, nil, "the admin api is disabled"))
+			c.Abort()
+			return
+		}
+
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="admin"`)
+			respondError(c, utils.Errorf(utils.ErrUnauthorized, nil, "missing or wrong bearer token"))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,161 @@
+package routes
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	cal "usicalendar/calendar"
+	mh "usicalendar/mongo_connection_handler"
+)
+
+// Reads the link options from the query string. Returns nil when no option is set
+// and false when one of them is malformed.
+func linkOptionsFromQuery(c *gin.Context) (*mh.LinkOptions, bool) {
+	overrides, ok := linkOverridesFromQuery(c)
+
+	if !ok || overrides == nil {
+		return nil, ok
+	}
+
+	options := overrides.Apply(mh.LinkOptions{})
+
+	if reflect.DeepEqual(options, mh.LinkOptions{}) {
+		return nil, true
+	}
+
+	return &options, true
+}
+
+// Reads the options given in the query string to override the ones stored with a link.
+// Returns nil when no option is given and false when one of them is malformed.
+func linkOverridesFromQuery(c *gin.Context) (*mh.LinkOverrides, bool) {
+	var overrides mh.LinkOverrides
+	var set bool = false
+
+	if v, ok := c.GetQuery("alarm"); ok {
+		minutes, valid := parseAlarmMinutes(v)
+		if !valid {
+			return nil, false
+		}
+		overrides.AlarmMinutes = &minutes
+		set = true
+	}
+
+	if v, ok := c.GetQuery("exam_alarm"); ok {
+		minutes, valid := parseAlarmMinutes(v)
+		if !valid {
+			return nil, false
+		}
+		overrides.ExamAlarmMinutes = &minutes
+		set = true
+	}
+
+	if v, ok := c.GetQuery("name"); ok {
+		if v = strings.TrimSpace(v); len(v) > cal.MaxNameLength {
+			return nil, false
+		}
+		overrides.Name = &v
+		set = true
+	}
+
+	if v, ok := c.GetQuery("description"); ok {
+		if v = strings.TrimSpace(v); len(v) > cal.MaxDescriptionLength {
+			return nil, false
+		}
+		overrides.Description = &v
+		set = true
+	}
+
+	if v, ok := c.GetQuery("color"); ok {
+		color := ""
+		// an empty colour removes the stored one
+		if strings.TrimSpace(v) != "" {
+			normalized, valid := cal.NormalizeColor(v)
+			if !valid {
+				return nil, false
+			}
+			color = normalized
+		}
+		overrides.Color = &color
+		set = true
+	}
+
+	if v, ok := c.GetQuery("display"); ok {
+		display, valid := parseDisplay(v)
+		if !valid {
+			return nil, false
+		}
+		overrides.Display = &display
+		set = true
+	}
+
+	if v, ok := c.GetQuery("append_room"); ok {
+		appendRoom, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, false
+		}
+		overrides.AppendRoom = &appendRoom
+		set = true
+	}
+
+	if v, ok := c.GetQuery("compact"); ok {
+		compact, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, false
+		}
+		overrides.Compact = &compact
+		set = true
+	}
+
+	if !set {
+		return nil, true
+	}
+
+	return &overrides, true
+}
+
+func parseAlarmMinutes(v string) (int, bool) {
+	minutes, err := strconv.Atoi(v)
+
+	if err != nil || minutes < 0 || minutes > cal.MaxAlarmMinutes {
+		return 0, false
+	}
+
+	return minutes, true
+}
+
+// Parses the per-subject display overrides, given as a JSON object keyed by subject:
+// {"<subject>": {"nickname": "...", "prefix": "...", "suffix": "...", "emoji": "..."}}
+func parseDisplay(v string) ([]mh.SubjectDisplay, bool) {
+	var bySubject map[string]mh.SubjectDisplay
+
+	if err := json.Unmarshal([]byte(v), &bySubject); err != nil {
+		return nil, false
+	}
+
+	if len(bySubject) == 0 {
+		return nil, true
+	}
+
+	display := make([]mh.SubjectDisplay, 0, len(bySubject))
+
+	for subject, d := range bySubject {
+		if subject == "" || len(d.Nickname) > cal.MaxDisplayLength || len(d.Prefix) > cal.MaxDisplayLength ||
+			len(d.Suffix) > cal.MaxDisplayLength || len(d.Emoji) > cal.MaxDisplayLength {
+			return nil, false
+		}
+		d.Subject = subject
+		display = append(display, d)
+	}
+
+	sort.Slice(display, func(i, j int) bool {
+		return display[i].Subject < display[j].Subject
+	})
+
+	return display, true
+}
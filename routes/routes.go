@@ -7,6 +7,8 @@ import (
 
 	cal "usicalendar/calendar"
 	mongo "usicalendar/mongo"
+
+	ics "github.com/arran4/golang-ical"
 )
 
 const (
@@ -16,21 +18,23 @@ const (
 	ContentTypeCalendar = "text/calendar"
 )
 
+const FailedSubjectsHeader = "X-Failed-Subjects"
+
 func GetInfoFromUrl(c *gin.Context) {
 
 	var url string = c.Query("url")
 
-	if url == "" || !strings.HasPrefix(url, "https://search.usi.ch/") {
-		c.Status(400)
+	if url == "" {
+		badRequest(c, "url is required")
 		return
 	}
 
 	setAccessControlHeader(c)
 
-	subjectsMap, _ := cal.GetAllSubjects(&url)
+	subjectsMap, _, err := cal.GetAllSubjects(c.Request.Context(), &url)
 
-	if subjectsMap == nil {
-		c.Status(400)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
@@ -41,7 +45,13 @@ func GetInfoFromUrl(c *gin.Context) {
 		subjects[i] = strings.Clone(key)
 		i++
 	}
-	subjectsNames := mongo.SubjIdToName(subjects)
+	subjectsNames, err := mongo.SubjIdToName(c.Request.Context(), subjects)
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
 	subjectsMap = nil
 
 	var r string = "{\"courses\": ["
@@ -64,7 +74,7 @@ func GetInfoFromId(c *gin.Context) {
 	var idss string = c.Query("ids")
 
 	if idss == "" {
-		c.Status(400)
+		badRequest(c, "ids is required")
 		return
 	}
 
@@ -72,7 +82,12 @@ func GetInfoFromId(c *gin.Context) {
 
 	setAccessControlHeader(c)
 
-	subjectsNames := mongo.SubjIdToName(ids)
+	subjectsNames, err := mongo.SubjIdToName(c.Request.Context(), ids)
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 
 	var r string = "{\"courses\": ["
 	var last int = len(ids) - 1
@@ -93,8 +108,8 @@ func GetShorten(c *gin.Context) {
 	var url string = c.Query("url")
 	var subjectsString string = c.Query("subjects")
 
-	if url == "" || !strings.HasPrefix(url, "https://search.usi.ch/") || subjectsString == "" {
-		c.Status(400)
+	if url == "" || subjectsString == "" {
+		badRequest(c, "url and subjects are required")
 		return
 	}
 
@@ -103,10 +118,17 @@ func GetShorten(c *gin.Context) {
 
 	subjects := strings.Split(subjectsString, "~")
 
-	short := mongo.Shorten(&url, &subjects)
+	options, ok := linkOptionsFromQuery(c)
+
+	if !ok {
+		badRequest(c, "invalid link options")
+		return
+	}
+
+	short, err := mongo.Shorten(c.Request.Context(), &url, &subjects, options)
 
-	if short == nil {
-		c.Status(400)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
@@ -124,13 +146,13 @@ func GetComplexShorten(c *gin.Context) {
 	var hbcbool bool = false
 
 	if hasBaseCalendar == "" || extraSubjectsString == "" {
-		c.Status(400)
+		badRequest(c, "has_base_calendar and extra_subjects are required")
 		return
 	}
 
 	if hasBaseCalendar == "true" {
-		if url == "" || !strings.HasPrefix(url, "https://search.usi.ch/") || subjectsString == "" {
-			c.Status(400)
+		if url == "" || subjectsString == "" {
+			badRequest(c, "url and subjects are required with a base calendar")
 			return
 		}
 		hbcbool = true
@@ -145,10 +167,17 @@ func GetComplexShorten(c *gin.Context) {
 
 	extraSubjects := strings.Split(extraSubjectsString, "~")
 
-	short := mongo.ShortenComplex(hbcbool, &url, &subjects, &extraSubjects)
+	options, ok := linkOptionsFromQuery(c)
 
-	if short == nil {
-		c.Status(400)
+	if !ok {
+		badRequest(c, "invalid link options")
+		return
+	}
+
+	short, err := mongo.ShortenComplex(c.Request.Context(), hbcbool, &url, &subjects, &extraSubjects, options)
+
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
@@ -166,14 +195,42 @@ func GetShortened(c *gin.Context) {
 
 	// fmt.Println(short)
 
-	calendar := mongo.FromShortened(&short)
+	overrides, ok := linkOverridesFromQuery(c)
+
+	if !ok {
+		badRequest(c, "invalid link options")
+		return
+	}
+
+	format, ok := requestedFormat(c)
+
+	if !ok {
+		badRequest(c, "unknown format")
+		return
+	}
+
+	past, at, ok := requestedTime(c)
 
-	if calendar == nil {
-		c.Status(404)
+	if !ok {
+		badRequest(c, "at must be a RFC 3339 time or a date as YYYY-MM-DD")
 		return
 	}
 
-	c.Data(200, ContentTypeCalendar, []byte(calendar.Serialize()))
+	var calendar *ics.Calendar
+	var err error
+
+	if past {
+		calendar, err = mongo.FromShortenedAt(c.Request.Context(), &short, at, overrides)
+	} else {
+		calendar, err = mongo.FromShortened(c.Request.Context(), &short, overrides)
+	}
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	serveCalendar(c, calendar, format)
 }
 
 func GetComplexShortened(c *gin.Context) {
@@ -182,22 +239,57 @@ func GetComplexShortened(c *gin.Context) {
 
 	var short string = c.Param("shortened")
 
-	calendar := mongo.FromComplexShortened(&short)
+	overrides, ok := linkOverridesFromQuery(c)
+
+	if !ok {
+		badRequest(c, "invalid link options")
+		return
+	}
+
+	format, ok := requestedFormat(c)
+
+	if !ok {
+		badRequest(c, "unknown format")
+		return
+	}
+
+	past, at, ok := requestedTime(c)
+
+	if !ok {
+		badRequest(c, "at must be a RFC 3339 time or a date as YYYY-MM-DD")
+		return
+	}
+
+	var calendar *ics.Calendar
+	var failed []string
+	var err error
+
+	if past {
+		calendar, err = mongo.FromComplexShortenedAt(c.Request.Context(), &short, at, overrides)
+	} else {
+		calendar, failed, err = mongo.FromComplexShortenedPartial(c.Request.Context(), &short, overrides)
+	}
+
+	// Subjects whose calendar could not be fetched are left out and listed in a header
+	if len(failed) > 0 {
+		c.Header("Access-Control-Expose-Headers", FailedSubjectsHeader)
+		c.Header(FailedSubjectsHeader, strings.Join(failed, "~"))
+	}
 
-	if calendar == nil {
-		c.Status(404)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
-	c.Data(200, ContentTypeCalendar, []byte(*calendar))
+	serveCalendar(c, calendar, format)
 }
 
 func GetCalendars(c *gin.Context) {
 	setAccessControlHeader(c)
-	var data *string = mongo.LatestCourses()
+	data, err := mongo.LatestCourses(c.Request.Context())
 
-	if data == nil {
-		c.Status(400)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
@@ -206,10 +298,10 @@ func GetCalendars(c *gin.Context) {
 
 func GetAllCourses(c *gin.Context) {
 	setAccessControlHeader(c)
-	var data *string = mongo.InfoAllCourses()
+	data, err := mongo.InfoAllCourses(c.Request.Context())
 
-	if data == nil {
-		c.Status(400)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
@@ -0,0 +1,44 @@
+package routes
+
+import (
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+
+	cache "usicalendar/cache"
+	utils "usicalendar/utils"
+)
+
+// Storage used by the cached calendars before and after compression.
+// Scans the whole cache collections, only served to administrators.
+func GetCacheStats(c *gin.Context) {
+
+	stats, err := cache.StorageStats(c.Request.Context())
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	r, err := json.Marshal(stats)
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Data(200, ContentTypeJSON, r)
+}
+
+// State of the circuit breaker and counters of the requests to search.usi.ch
+func GetUpstreamStats(c *gin.Context) {
+
+	r, err := json.Marshal(utils.UpstreamState())
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Data(200, ContentTypeJSON, r)
+}
@@ -0,0 +1,99 @@
+package routes
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	cal "usicalendar/calendar"
+	mongo "usicalendar/mongo"
+	mh "usicalendar/mongo_connection_handler"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+const ContentTypeSVG = "image/svg+xml"
+
+func GetTimetable(c *gin.Context) {
+	timetable(c, mongo.FromShortened)
+}
+
+func GetComplexTimetable(c *gin.Context) {
+	timetable(c, mongo.FromComplexShortened)
+}
+
+// Weekly grid of a link.
+// Query: [week=YYYY-MM-DD, any day of the week] [tz=Europe/Zurich] [format=html|svg]
+func timetable(c *gin.Context, render func(context.Context, *string, *mh.LinkOverrides) (*ics.Calendar, error)) {
+
+	setAccessControlHeader(c)
+
+	var short string = c.Param("shortened")
+
+	tz := c.DefaultQuery("tz", defaultTimezone)
+
+	loc, err := time.LoadLocation(tz)
+
+	if err != nil {
+		badRequest(c, "unknown time zone")
+		return
+	}
+
+	day := time.Now()
+
+	if week := c.Query("week"); week != "" {
+		if day, err = time.ParseInLocation("2006-01-02", week, loc); err != nil {
+			badRequest(c, "week must be a date as YYYY-MM-DD")
+			return
+		}
+	}
+
+	format := c.DefaultQuery("format", "html")
+
+	if format != "html" && format != "svg" {
+		badRequest(c, "format must be html or svg")
+		return
+	}
+
+	overrides, ok := linkOverridesFromQuery(c)
+
+	if !ok {
+		badRequest(c, "invalid link options")
+		return
+	}
+
+	calendar, err := render(c.Request.Context(), &short, overrides)
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	monday := cal.WeekStart(day, loc)
+
+	events := cal.OccurrenceEntries(calendar, monday, monday.AddDate(0, 0, 7))
+	fillSubjectNames(c.Request.Context(), events)
+
+	grid := cal.WeekTimetable(events, monday, loc)
+
+	if format == "svg" {
+		c.Data(200, ContentTypeSVG, []byte(grid.SVG()))
+		return
+	}
+
+	title := cal.CalendarName(calendar)
+
+	if title == "" {
+		title = "USI Calendar"
+	}
+
+	page, err := grid.HTML(title, c.Request.URL.Query())
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Data(200, ContentTypeHTML, page)
+}
@@ -0,0 +1,144 @@
+package routes
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	mongo "usicalendar/mongo"
+	mh "usicalendar/mongo_connection_handler"
+	utils "usicalendar/utils"
+	webhooks "usicalendar/webhooks"
+)
+
+// Header carrying the token of a webhook, for clients that cannot set Authorization
+const WebhookTokenHeader = "X-Webhook-Token"
+
+func PostWebhook(c *gin.Context) {
+	addWebhook(c, false)
+}
+
+func PostComplexWebhook(c *gin.Context) {
+	addWebhook(c, true)
+}
+
+func GetWebhook(c *gin.Context) {
+	showWebhook(c, false)
+}
+
+func GetComplexWebhook(c *gin.Context) {
+	showWebhook(c, true)
+}
+
+func DeleteWebhook(c *gin.Context) {
+	removeWebhook(c, false)
+}
+
+func DeleteComplexWebhook(c *gin.Context) {
+	removeWebhook(c, true)
+}
+
+// Registers a webhook notified of the schedule changes of the link.
+// Query: url=<http(s) url of a public host>. The secret in the response signs the payloads,
+// the token is needed to show or delete the webhook. Neither is shown again.
+func addWebhook(c *gin.Context, complex bool) {
+
+	setAccessControlHeader(c)
+
+	var short string = c.Param("shortened")
+	var target string = c.Query("url")
+
+	if err := webhooks.CheckTarget(c.Request.Context(), target); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	hook, token, err := mongo.AddWebhook(c.Request.Context(), &short, complex, &target)
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	r, err := json.Marshal(map[string]interface{}{"id": hook.ID.Hex(), "url": hook.Url, "secret": hook.Secret, "token": token})
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Data(201, ContentTypeJSON, r)
+}
+
+// Shows a webhook with its recent deliveries.
+// Header: Authorization: Bearer <token returned on registration> or X-Webhook-Token: <token>
+func showWebhook(c *gin.Context, complex bool) {
+
+	setAccessControlHeader(c)
+
+	hook, err := authorizedWebhook(c, complex)
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	deliveries, err := mongo.WebhookDeliveries(c.Request.Context(), hook)
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	r, err := json.Marshal(map[string]interface{}{"webhook": hook, "deliveries": deliveries})
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Data(200, ContentTypeJSON, r)
+}
+
+// Header: Authorization: Bearer <token returned on registration> or X-Webhook-Token: <token>
+func removeWebhook(c *gin.Context, complex bool) {
+
+	setAccessControlHeader(c)
+
+	hook, err := authorizedWebhook(c, complex)
+
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := mongo.DeleteWebhook(c.Request.Context(), hook); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+// Webhook of the request, ErrNotFound also when the token is missing or wrong
+func authorizedWebhook(c *gin.Context, complex bool) (*mh.Webhook, error) {
+	var short string = c.Param("shortened")
+	var id string = c.Param("id")
+	var token string = webhookToken(c)
+
+	if token == "" {
+		return nil, utils.Errorf(utils.ErrNotFound, nil, "webhook %s", id)
+	}
+
+	return mongo.FindWebhook(c.Request.Context(), &short, complex, &id, &token)
+}
+
+// Token of the webhook sent with the request. It is never read from the query, where it would
+// end up in access logs and browser histories.
+func webhookToken(c *gin.Context) string {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return c.GetHeader(WebhookTokenHeader)
+}
@@ -8,6 +8,17 @@ import json
 from tqdm import tqdm
 from ics import Calendar
 from datetime import datetime
+import gzip
+import csv
+import io
+import zipfile
+import re
+import hmac
+import hashlib
+import threading
+import time
+from http.server import BaseHTTPRequestHandler, HTTPServer
+import xml.etree.ElementTree as ET
 
 load_dotenv()
 
@@ -20,6 +31,30 @@ SUBJECT_CACHE_COL = DB["subject_calendar_cache"]
 
 URL = os.getenv("TEST_URL")
 
+# address of this machine as seen by the server, used by the webhook receiver
+WEBHOOK_HOST = os.getenv("TEST_WEBHOOK_HOST", "127.0.0.1")
+WEBHOOK_PORT = int(os.getenv("TEST_WEBHOOK_PORT", "8099"))
+# a private TEST_WEBHOOK_HOST needs a server started with WEBHOOK_ALLOW_PRIVATE_TARGETS=true
+WEBHOOK_PRIVATE_ALLOWED = os.getenv("WEBHOOK_ALLOW_PRIVATE_TARGETS") == "true"
+MAX_WEBHOOKS_PER_LINK = 5
+MAX_WEBHOOK_REGISTRATIONS = 10
+
+ADMIN_HEADERS = {"Authorization": f"Bearer {os.getenv('ADMIN_TOKEN')}"}
+
+SCHEDULE_CHANGES_COL = DB["schedule_changes"]
+SNAPSHOTS_COL = DB["calendar_snapshots"]
+BLOBS_COL = DB["calendar_blobs"]
+NEGATIVE_CACHE_COL = DB["negative_cache"]
+REJECTED_COL = DB["rejected_calendars"]
+
+# set on a cache document to make it stale, the expiry is computed per entry
+EXPIRED = {"date_added": 976057200, "expires_at": 976057200}
+
+# cache ttl bounds of the server, in seconds
+CACHE_TTL = int(os.getenv("CACHE_TTL_MS") or 43200000) // 1000
+CACHE_MIN_TTL = int(os.getenv("CACHE_MIN_TTL_MS") or 3600000) // 1000
+UPSTREAM_MAX_QUEUE = int(os.getenv("UPSTREAM_MAX_QUEUE") or 100)
+
 def test_random_existing_should_not_add_entry():
     print("[INFO] Make sure the no external connections are allowed during testing")
     if check_for_duplicates() is not None:
@@ -261,6 +296,346 @@ def test_s_route():
 
     return 1
 
+def test_link_option_overrides():
+    print("[LOG] Testing query overrides of the stored link options")
+
+    res = requests.get(f"{URL}courses")
+    assert res.ok
+    course_url = random.choice(json.loads(res.text)['cals'])
+
+    res = requests.get(f"{URL}urlinfo?url={course_url}")
+    assert res.ok
+    subjects = "~".join(s[0] for s in json.loads(res.text)["courses"])
+
+    res = requests.get(f"{URL}shorten?url={course_url}&subjects={subjects}&alarm=15&color=336699&name=Stored")
+    assert res.ok
+    short = json.loads(res.text)["shortened"].split("/")[-1]
+
+    res = requests.get(f"{URL}s/{short}")
+    assert res.ok
+    assert "BEGIN:VALARM" in res.text or "BEGIN:VEVENT" not in res.text
+    assert "X-WR-CALNAME:Stored" in res.text
+
+    # explicit zero and empty values turn off the stored options
+    res = requests.get(f"{URL}s/{short}?alarm=0&color=&name=")
+    assert res.ok
+    assert "BEGIN:VALARM" not in res.text
+    assert "X-APPLE-CALENDAR-COLOR" not in res.text
+    assert "X-WR-CALNAME:Stored" not in res.text
+
+    remove_simple_from_db(short)
+
+    print("[LOG] Test passed")
+
+    return 1
+
+def test_timetable_navigation():
+    print("[LOG] Testing that the timetable week links keep the query")
+
+    doc = COL.aggregate([{ "$sample": { "size": 1 } }]).next()
+
+    res = requests.get(f"{URL}s/{doc['short_url']}/timetable?week=2024-03-06&tz=Europe/Zurich&alarm=0&name=Week+view")
+    assert res.ok
+
+    assert "week=2024-02-26" in res.text and "week=2024-03-11" in res.text
+    for param in ["alarm=0", "name=Week+view", "tz=Europe%2FZurich"]:
+        assert res.text.count(param) >= 3, param
+
+    print("[LOG] Test passed")
+
+    return 1
+
+def test_freetime():
+    print("[LOG] Testing the common free time of links")
+
+    shorts = [doc["short_url"] for doc in COL.aggregate([{ "$sample": { "size": 2 } }])]
+    query = {"links": "~".join(shorts), "from": "2024-03-04", "to": "2024-03-08", "tz": "Europe/Zurich"}
+
+    res = requests.get(f"{URL}freetime", params={**query, "day_start": "08:00", "day_end": "24:00", "min_duration": "15"})
+    assert res.ok
+    slots = json.loads(res.text)["free"]
+    assert len(slots) > 0
+    for slot in slots:
+        start, end = datetime.fromisoformat(slot["start"]), datetime.fromisoformat(slot["end"])
+        assert start < end and (end - start).total_seconds() >= 15 * 60
+        assert "2024-03-04" <= slot["start"][:10] <= "2024-03-08"
+        assert start.hour >= 8
+        # slots run up to midnight at most
+        assert end.date() == start.date() or (end.hour, end.minute) == (0, 0)
+    # nobody has lectures at night, the evenings are free up to 24:00
+    assert any(slot["end"].startswith("2024-03-05T00:00:00") for slot in slots)
+
+    res = requests.get(f"{URL}freetime", params={**query, "format": "ics"})
+    assert res.ok
+    assert res.headers["Content-Type"].startswith("text/calendar")
+
+    res = requests.get(f"{URL}freetime", params={**query, "from": "2024-03-08", "to": "2024-03-04"})
+    assert res.status_code == 400
+
+    for day_start, day_end in [("08:00", "25:00"), ("8h", "19:00"), ("08:00", "24:01"), ("24:00", "24:00"), ("19:00", "08:00")]:
+        res = requests.get(f"{URL}freetime", params={**query, "day_start": day_start, "day_end": day_end})
+        assert res.status_code == 400, (day_start, day_end)
+
+    print("[LOG] Test passed")
+
+    return 1
+
+def test_next_events():
+    print("[LOG] Testing the next events of a link")
+
+    short = COL.aggregate([{ "$sample": { "size": 1 } }]).next()["short_url"]
+    complex_short = COMPLEX_COL.aggregate([{ "$sample": { "size": 1 } }]).next()["short_url"]
+
+    for path in [f"s/{short}", f"cs/{complex_short}"]:
+        res = requests.get(f"{URL}{path}/next", params={"count": 3, "tz": "Europe/Zurich"})
+        assert res.ok
+        assert res.headers["Content-Type"].startswith("application/json")
+        events = json.loads(res.text)["events"]
+        assert len(events) <= 3
+
+        starts = [datetime.fromisoformat(e["start"]) for e in events]
+        assert starts == sorted(starts)
+        for e in events:
+            # events that have not ended yet
+            assert datetime.fromisoformat(e.get("end", e["start"])).timestamp() >= time.time() - 60
+            assert e["type"] in ("lecture", "exam")
+
+    for params in [{"count": 0}, {"count": 51}, {"count": "few"}, {"tz": "Mars/Olympus"}]:
+        res = requests.get(f"{URL}s/{short}/next", params=params)
+        assert res.status_code == 400, params
+
+    res = requests.get(f"{URL}s/{''.join(random.choices(string.ascii_letters, k=14))}/next")
+    assert res.status_code == 404
+
+    print("[LOG] Test passed")
+
+    return 1
+
+def event_keys(res):
+    return sorted((e["start"], e["summary"], e.get("location", "")) for e in json.loads(res.text)["events"])
+
+def test_recurrence_round_trip():
+    print("[LOG] Testing that compacted recurring events expand back to the original events")
+
+    doc = COL.aggregate([{ "$sample": { "size": 1 } }]).next()
+    short = doc["short_url"]
+
+    res = requests.get(f"{URL}s/{short}?format=json&compact=false")
+    assert res.ok
+    plain = event_keys(res)
+
+    res = requests.get(f"{URL}s/{short}?compact=true")
+    assert res.ok
+    compacted = Calendar(res.text)
+    assert len(compacted.events) <= len(plain)
+
+    # the weekly RRULEs and EXDATEs of the compacted calendar are expanded by /json
+    res = requests.get(f"{URL}s/{short}?format=json&compact=true")
+    assert res.ok
+    assert event_keys(res) == plain
+
+    if plain:
+        # a range only returns the occurrences inside it
+        day = plain[0][0][:10]
+        res = requests.get(f"{URL}s/{short}?format=json&compact=true&from={day}&to={day}")
+        assert res.ok
+        ranged = event_keys(res)
+        assert plain[0] in ranged and len(ranged) <= len(plain)
+
+    res = requests.get(f"{URL}s/{short}?format=json&from=2024-03-10&to=2024-03-01")
+    assert res.status_code == 400
+
+    print("[LOG] Test passed")
+
+    return 1
+
+def test_calendar_formats():
+    print("[LOG] Testing the jCal and JSON formats")
+
+    doc = COL.aggregate([{ "$sample": { "size": 1 } }]).next()
+    short = doc["short_url"]
+
+    res = requests.get(f"{URL}s/{short}")
+    assert res.ok
+    vevents = res.text.count("BEGIN:VEVENT")
+
+    res = requests.get(f"{URL}s/{short}?format=jcal")
+    assert res.ok
+    assert res.headers["Content-Type"].startswith("application/calendar+json")
+    jcal = json.loads(res.text)
+    assert jcal[0] == "vcalendar"
+    assert len([c for c in jcal[2] if c[0] == "vevent"]) == vevents
+    for component in jcal[2]:
+        for prop in component[1]:
+            # name, parameters, value type and at least one value
+            assert len(prop) >= 4 and prop[0] == prop[0].lower()
+
+    res = requests.get(f"{URL}s/{short}", headers={"Accept": "application/calendar+json"})
+    assert res.ok
+    assert json.loads(res.text)[0] == "vcalendar"
+
+    # the weights of the Accept header decide, text/calendar wins ties
+    for accept, content_type in [
+        ("text/calendar, application/json;q=0.1", "text/calendar"),
+        ("text/calendar;q=0.2, application/json", "application/json"),
+        ("application/json;q=0.5, text/calendar;q=0.5", "text/calendar"),
+        ("application/json;q=0, */*", "text/calendar"),
+        ("text/*;q=0.3, text/csv", "text/csv"),
+    ]:
+        res = requests.get(f"{URL}s/{short}", headers={"Accept": accept})
+        assert res.ok
+        assert res.headers["Content-Type"].startswith(content_type), accept
+
+    res = requests.get(f"{URL}s/{short}?format=json")
+    assert res.ok
+    events = json.loads(res.text)["events"]
+    assert (len(events) > 0) == (vevents > 0)
+    assert all(e["type"] in ("lecture", "exam") and "start" in e for e in events)
+
+    res = requests.get(f"{URL}s/{short}?format=pdf")
+    assert res.status_code == 400
+
+    print("[LOG] Test passed")
+
+    return 1
+
+def test_spreadsheet_exports():
+    print("[LOG] Testing the CSV and XLSX exports")
+
+    doc = COL.aggregate([{ "$sample": { "size": 1 } }]).next()
+    short = doc["short_url"]
+
+    res = requests.get(f"{URL}s/{short}?format=json")
+    assert res.ok
+    events = json.loads(res.text)["events"]
+
+    res = requests.get(f"{URL}s/{short}?format=csv")
+    assert res.ok
+    assert res.headers["Content-Type"].startswith("text/csv")
+    rows = list(csv.reader(io.StringIO(res.text)))
+    assert rows[0] == ["date", "start_time", "end_time", "subject_name", "summary", "location", "type"]
+    assert len(rows) == len(events) + 1
+
+    res = requests.get(f"{URL}s/{short}?format=csv&columns=date~summary&tz=UTC")
+    assert res.ok
+    rows = list(csv.reader(io.StringIO(res.text)))
+    assert rows[0] == ["date", "summary"]
+    assert all(len(row) == 2 for row in rows)
+    assert [row[1] for row in rows[1:]] == [e["summary"] for e in events]
+
+    res = requests.get(f"{URL}s/{short}?format=csv&columns=date~password")
+    assert res.status_code == 400
+
+    res = requests.get(f"{URL}s/{short}?format=xlsx")
+    assert res.ok
+    workbook = zipfile.ZipFile(io.BytesIO(res.content))
+    assert "xl/worksheets/sheet1.xml" in workbook.namelist()
+    sheet = workbook.read("xl/worksheets/sheet1.xml").decode()
+    assert sheet.count("<row") == len(events) + 1
+
+    print("[LOG] Test passed")
+
+    return 1
+
+def test_course_url_forms():
+    print("[LOG] Testing the accepted and rejected course url forms")
+
+    res = requests.get(f"{URL}courses")
+    assert res.ok
+    course_url = random.choice(json.loads(res.text)['cals'])
+
+    res = requests.get(f"{URL}urlinfo?url={course_url}")
+    assert res.ok
+    subjects = "~".join(s[0] for s in json.loads(res.text)["courses"])
+
+    m = re.search(r"/educations/(\d+)/(?:[^/]+/)?schedules", course_url)
+    assert m
+    prefix, suffix = course_url[:m.start()], course_url[m.end():]
+    course_id = m.group(1)
+
+    res = requests.get(f"{URL}shorten", params={"url": course_url, "subjects": subjects})
+    assert res.ok
+    short = json.loads(res.text)["shortened"].split("/")[-1]
+
+    # the slug is ignored, every form is stored as the same canonical url
+    variant = f"{prefix}/educations/{course_id}/another-slug/schedules{suffix}"
+    res = requests.get(f"{URL}shorten", params={"url": variant, "subjects": subjects})
+    assert res.ok
+    assert json.loads(res.text)["shortened"].split("/")[-1] == short
+    assert "/*/schedules" in COL.find_one({"short_url": short})["url"]
+
+    for invalid in [
+        course_url.replace("https://", "http://"),
+        course_url.replace("search.usi.ch", "search.usi.ch.example.com"),
+        course_url.replace("search.usi.ch", "user@search.usi.ch"),
+        course_url.replace("search.usi.ch", "search.usi.ch:8443"),
+        course_url + "?redirect=https://example.com",
+        f"{prefix}/educations/{course_id}/schedules/../../admin{suffix}",
+        f"{prefix}/educations/abc/schedules{suffix}",
+    ]:
+        res = requests.get(f"{URL}shorten", params={"url": invalid, "subjects": subjects})
+        assert res.status_code == 400, invalid
+
+    remove_simple_from_db(short)
+
+    # a link stored with the url as given before urls were canonicalised is reused
+    legacy = ''.join(random.choices(string.ascii_letters + string.digits, k=14))
+    COL.insert_one({"url": variant, "subjects": sorted(subjects.split("~")), "short_url": legacy})
+    res = requests.get(f"{URL}shorten", params={"url": variant, "subjects": subjects})
+    assert res.ok
+    assert json.loads(res.text)["shortened"].split("/")[-1] == legacy
+
+    remove_simple_from_db(legacy)
+
+    print("[LOG] Test passed")
+
+    return 1
+
+def test_upstream_stats():
+    print("[LOG] Testing the upstream retry and circuit breaker statistics")
+
+    assert requests.get(f"{URL}admin/upstreamstats").status_code == 401
+
+    res = requests.get(f"{URL}admin/upstreamstats", headers=ADMIN_HEADERS)
+    assert res.ok
+    stats = json.loads(res.text)
+
+    assert stats["state"] in ("closed", "open", "half_open")
+    assert stats["consecutive_failures"] >= 0
+    assert stats["consecutive_failures"] <= stats["failures"]
+    # failures and retries are counted per attempt, every trip follows a failed attempt
+    assert stats["failures"] <= stats["attempts"]
+    assert stats["retries"] <= stats["attempts"]
+    assert stats["trips"] <= stats["failures"]
+    if stats["state"] == "open":
+        assert stats["opened_at"] > 0
+
+    print("[LOG] Test passed")
+
+    return 1
+
+def test_upstream_rate_limit():
+    print("[LOG] Testing the upstream rate limiter statistics")
+
+    before = json.loads(requests.get(f"{URL}admin/upstreamstats", headers=ADMIN_HEADERS).text)
+
+    # expired entries make the calendars go upstream through the rate limiter again
+    COURSE_CACHE_COL.update_many({}, {"$set": EXPIRED})
+    for link in COL.find().limit(3):
+        requests.get(f"{URL}s/{link['short_url']}")
+
+    after = json.loads(requests.get(f"{URL}admin/upstreamstats", headers=ADMIN_HEADERS).text)
+
+    for key in ("waiting", "delayed", "queue_full"):
+        assert 0 <= before[key]
+        assert key == "waiting" or before[key] <= after[key]
+    assert after["waiting"] <= UPSTREAM_MAX_QUEUE
+    assert before["requests"] <= after["requests"]
+
+    print("[LOG] Test passed")
+
+    return 1
+
 # Complex calendar testing
 
 
@@ -404,7 +779,7 @@ def test_complex_cal_shorten():
 
 def force_subject_cache_update(ids, complexshort):
     for id in ids:
-        result = SUBJECT_CACHE_COL.update_one({'id':id},{ "$set": { "date_added":  976057200} })
+        result = SUBJECT_CACHE_COL.update_one({'id':id},{ "$set": EXPIRED })
         assert SUBJECT_CACHE_COL.find_one({'id':id})['date_added'] == 976057200
         if result.modified_count != 1:
             print(f"[ERROR] Did not update subject {id}")
@@ -438,7 +813,7 @@ def test_course_cache():
 
     doc1 = COURSE_CACHE_COL.aggregate([{ "$sample": { "size": 1 } }]).next()
 
-    COURSE_CACHE_COL.update_one({'_id':doc1['_id']},{ "$set": { "date_added":  976057200} })
+    COURSE_CACHE_COL.update_one({'_id':doc1['_id']},{ "$set": EXPIRED })
 
     assert COURSE_CACHE_COL.find_one({'_id':doc1['_id']})['date_added'] == 976057200
 
@@ -459,7 +834,7 @@ def test_subject_cache():
 
     doc1 = SUBJECT_CACHE_COL.aggregate([{ "$sample": { "size": 1 } }]).next()
 
-    SUBJECT_CACHE_COL.update_one({'_id':doc1['_id']},{ "$set": { "date_added":  976057200} })
+    SUBJECT_CACHE_COL.update_one({'_id':doc1['_id']},{ "$set": EXPIRED })
 
     assert SUBJECT_CACHE_COL.find_one({'_id':doc1['_id']})['date_added'] == 976057200
 
@@ -480,6 +855,439 @@ def test_subject_cache():
     return 1
 
 
+def cached_data(doc):
+    if "data_gz" in doc:
+        return gzip.decompress(doc["data_gz"]).decode()
+    return doc["data"]
+
+
+def test_cache_compression():
+
+    print("[LOG] Testing compressed cache documents")
+
+    doc1 = COURSE_CACHE_COL.aggregate([{ "$sample": { "size": 1 } }]).next()
+
+    COURSE_CACHE_COL.update_one({'_id':doc1['_id']},{ "$set": EXPIRED })
+
+    res = requests.get(f"{URL}shorten?url={doc1['url']}&subjects=dsanidua~dsdasdsa")
+
+    doc1_new = COURSE_CACHE_COL.find_one({'_id':doc1['_id']})
+
+    assert "data" not in doc1_new
+    assert cached_data(doc1_new).startswith("BEGIN:VCALENDAR")
+    assert doc1_new['size'] == len(cached_data(doc1_new).encode())
+
+    assert requests.get(f"{URL}admin/cachestats").status_code == 401
+
+    res = requests.get(f"{URL}admin/cachestats", headers=ADMIN_HEADERS)
+    assert res.ok
+    assert json.loads(res.text)['course_cache']['compressed_bytes'] > 0
+
+    print("[LOG] Test passed")
+
+    return 1
+
+
+class WebhookReceiver(BaseHTTPRequestHandler):
+    received = []
+
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers["Content-Length"]))
+        WebhookReceiver.received.append((dict(self.headers), body))
+        self.send_response(204)
+        self.end_headers()
+
+    def log_message(self, format, *args):
+        pass
+
+
+def test_webhook():
+
+    print("[LOG] Testing webhook notifications")
+
+    server = HTTPServer(("", WEBHOOK_PORT), WebhookReceiver)
+    threading.Thread(target=server.serve_forever, daemon=True).start()
+
+    doc1 = SUBJECT_CACHE_COL.aggregate([{ "$match": { "size": { "$gt": 0 } } }, { "$sample": { "size": 1 } }]).next()
+
+    res = requests.get(f"{URL}cshorten?has_base_calendar=false&url=&subjects=dsanidua~dsdasdsa&extra_subjects={doc1['id']}")
+    assert res.ok
+
+    short = json.loads(res.text)['shortened'].split('/')[-1]
+
+    if not WEBHOOK_PRIVATE_ALLOWED:
+        for target in ["http://127.0.0.1/hook", "http://localhost:8080/", "http://10.1.2.3/", "http://169.254.169.254/latest/meta-data/", "http://[::1]/", "http://0.0.0.0/"]:
+            res = requests.post(f"{URL}cs/{short}/webhooks", params={"url": target})
+            assert res.status_code == 400, target
+
+    res = requests.post(f"{URL}cs/{short}/webhooks", params={"url": f"http://{WEBHOOK_HOST}:{WEBHOOK_PORT}/hook"})
+    assert res.status_code == 201
+    hook = json.loads(res.text)
+
+    # drop the first event from the cache so that the refresh reports it as added
+    data = cached_data(doc1)
+    start = data.index("BEGIN:VEVENT")
+    end = data.index("END:VEVENT", start) + len("END:VEVENT")
+    end += len(data[end:]) - len(data[end:].lstrip("\r\n"))
+    SUBJECT_CACHE_COL.update_one({'_id':doc1['_id']},{ "$set": { "data_gz": gzip.compress((data[:start] + data[end:]).encode()), **EXPIRED } })
+
+    WebhookReceiver.received = []
+    res = requests.get(f'{URL}cs/{short}')
+    assert res.ok
+
+    for _ in range(30):
+        if WebhookReceiver.received:
+            break
+        time.sleep(0.5)
+
+    server.shutdown()
+
+    assert len(WebhookReceiver.received) == 1
+    headers, body = WebhookReceiver.received[0]
+
+    signature = "sha256=" + hmac.new(hook['secret'].encode(), body, hashlib.sha256).hexdigest()
+    assert hmac.compare_digest(signature, headers["X-Usicalendar-Signature"])
+
+    payload = json.loads(body)
+    assert payload['link'] == short
+    assert any(change['change'] == 'added' for change in payload['changes'])
+
+    res = requests.get(f"{URL}cs/{short}/webhooks/{hook['id']}", headers={"X-Webhook-Token": "wrong"})
+    assert res.status_code == 404
+
+    # the token is not accepted in the query
+    res = requests.get(f"{URL}cs/{short}/webhooks/{hook['id']}", params={"token": hook['token']})
+    assert res.status_code == 404
+
+    # the secret shared with the receiver does not manage the webhook
+    res = requests.get(f"{URL}cs/{short}/webhooks/{hook['id']}", headers={"Authorization": f"Bearer {hook['secret']}"})
+    assert res.status_code == 404
+
+    res = requests.get(f"{URL}cs/{short}/webhooks/{hook['id']}", headers={"Authorization": f"Bearer {hook['token']}"})
+    assert res.ok
+    assert json.loads(res.text)['deliveries'][0]['delivered']
+
+    res = requests.delete(f"{URL}cs/{short}/webhooks/{hook['id']}", headers={"X-Webhook-Token": hook['token']})
+    assert res.status_code == 204
+
+    # a link holds MAX_WEBHOOKS_PER_LINK webhooks and gets MAX_WEBHOOK_REGISTRATIONS a day, deleted ones included
+    target = {"url": f"http://{WEBHOOK_HOST}:{WEBHOOK_PORT}/hook"}
+    registered = 1
+    hooks = []
+    for _ in range(MAX_WEBHOOKS_PER_LINK):
+        res = requests.post(f"{URL}cs/{short}/webhooks", params=target)
+        assert res.status_code == 201
+        hooks.append(json.loads(res.text))
+        registered += 1
+
+    assert requests.post(f"{URL}cs/{short}/webhooks", params=target).status_code == 409
+
+    for h in hooks:
+        res = requests.delete(f"{URL}cs/{short}/webhooks/{h['id']}", headers={"X-Webhook-Token": h['token']})
+        assert res.status_code == 204
+
+    while registered < MAX_WEBHOOK_REGISTRATIONS:
+        res = requests.post(f"{URL}cs/{short}/webhooks", params=target)
+        assert res.status_code == 201
+        registered += 1
+
+    assert requests.post(f"{URL}cs/{short}/webhooks", params=target).status_code == 429
+
+    print("[LOG] Test passed")
+
+    return 1
+
+
+def store_snapshot(kind, ref, raw, valid_from):
+    digest = hashlib.sha256(raw.encode()).hexdigest()
+    BLOBS_COL.update_one({"_id": digest}, {"$setOnInsert": {"data": gzip.compress(raw.encode()), "size": len(raw)}}, upsert=True)
+    return SNAPSHOTS_COL.insert_one({"kind": kind, "ref": ref, "hash": digest, "valid_from": valid_from}).inserted_id
+
+def test_calendar_history():
+    print("[LOG] Testing links rendered as they were at a past date")
+
+    doc1 = SUBJECT_CACHE_COL.aggregate([{ "$match": { "size": { "$gt": 0 } } }, { "$sample": { "size": 1 } }]).next()
+    data = cached_data(doc1)
+    assert "BEGIN:VEVENT" in data
+
+    res = requests.get(f"{URL}cshorten?has_base_calendar=false&url=&subjects=dsanidua~dsdasdsa&extra_subjects={doc1['id']}")
+    assert res.ok
+    short = json.loads(res.text)['shortened'].split('/')[-1]
+
+    # the calendar lost its first event between two snapshots in 2001 and 2002
+    start = data.index("BEGIN:VEVENT")
+    end = data.index("END:VEVENT", start) + len("END:VEVENT")
+    end += len(data[end:]) - len(data[end:].lstrip("\r\n"))
+    older = store_snapshot("subject", doc1['id'], data, 978303600)
+    newer = store_snapshot("subject", doc1['id'], data[:start] + data[end:], 1009839600)
+
+    res = requests.get(f"{URL}cs/{short}", params={"at": "2001-06-01"})
+    assert res.ok
+    before = res.text.count("BEGIN:VEVENT")
+
+    res = requests.get(f"{URL}cs/{short}", params={"at": "2002-06-01T12:00:00+02:00"})
+    assert res.ok
+    after = res.text.count("BEGIN:VEVENT")
+
+    assert before == data.count("BEGIN:VEVENT")
+    assert after == before - 1
+
+    # no snapshot is that old
+    res = requests.get(f"{URL}cs/{short}", params={"at": "2000-06-01"})
+    assert res.status_code == 404
+
+    for at in ["yesterday", "2001-13-01", "1001839600"]:
+        res = requests.get(f"{URL}cs/{short}", params={"at": at})
+        assert res.status_code == 400, at
+
+    SNAPSHOTS_COL.delete_many({"_id": {"$in": [older, newer]}})
+    remove_complex_from_db(short)
+
+    print("[LOG] Test passed")
+
+    return 1
+
+def upstream_requests():
+    res = requests.get(f"{URL}admin/upstreamstats", headers=ADMIN_HEADERS)
+    assert res.ok
+    return json.loads(res.text)["requests"]
+
+def test_negative_cache():
+    print("[LOG] Testing that missing calendars are not requested again while their negative entry lives")
+
+    subject = "9" + "".join(random.choices(string.digits, k=8))
+    short = ''.join(random.choices(string.ascii_letters + string.digits, k=14))
+    COMPLEX_COL.insert_one({"has_base_calendar": False, "url": "", "base_subjects": [], "extra_subjects": [subject], "short_url": short})
+    NEGATIVE_CACHE_COL.delete_many({"kind": "subject", "ref": subject})
+
+    # search.usi.ch answers 404 for the unknown subject and the answer is remembered
+    requested = upstream_requests()
+    res = requests.get(f"{URL}cs/{short}")
+    assert res.status_code == 404
+    assert upstream_requests() == requested + 1
+
+    for _ in range(10):
+        entry = NEGATIVE_CACHE_COL.find_one({"kind": "subject", "ref": subject})
+        if entry:
+            break
+        time.sleep(0.2)
+    assert entry["status"] == 404 and entry["expires_at"] > time.time()
+
+    # the second request is answered from the negative cache
+    res = requests.get(f"{URL}cs/{short}")
+    assert res.status_code == 404
+    assert "unavailable until" in json.loads(res.text)["error"]["message"]
+    assert upstream_requests() == requested + 1
+
+    # once the entry has expired the subject is requested again
+    NEGATIVE_CACHE_COL.update_one({"_id": entry["_id"]}, {"$set": {"expires_at": int(time.time()) - 1}})
+    res = requests.get(f"{URL}cs/{short}")
+    assert res.status_code == 404
+    assert upstream_requests() == requested + 2
+
+    NEGATIVE_CACHE_COL.delete_many({"kind": "subject", "ref": subject})
+    remove_complex_from_db(short)
+
+    print("[LOG] Test passed")
+
+    return 1
+
+def test_rejected_refresh():
+    print("[LOG] Testing that a failed refresh keeps the cached calendar")
+
+    doc1 = COURSE_CACHE_COL.aggregate([{ "$match": { "size": { "$gt": 0 } } }, { "$sample": { "size": 1 } }]).next()
+    data = cached_data(doc1)
+
+    # an entry of a course search.usi.ch does not serve a calendar for
+    course_id = "9" + "".join(random.choices(string.digits, k=8))
+    url = f"https://search.usi.ch/en/educations/{course_id}/*/schedules/ics"
+    entry = COURSE_CACHE_COL.insert_one({"url": url, "id": course_id, "data_gz": gzip.compress(data.encode()), "size": len(data), **EXPIRED}).inserted_id
+
+    res = requests.post(f"{URL}admin/cache/course/refresh", params={"url": url}, headers=ADMIN_HEADERS)
+    assert res.status_code in (404, 502)
+    reason = json.loads(res.text)["error"]["message"]
+
+    time.sleep(1)
+    stored = COURSE_CACHE_COL.find_one({"_id": entry})
+    assert cached_data(stored) == data
+    assert stored["date_added"] == EXPIRED["date_added"]
+    assert stored["last_error"]
+
+    # answers that are not calendars are kept apart for inspection
+    if any(r in reason for r in ["unexpected content type", "invalid calendar", "body too large"]):
+        rejection = REJECTED_COL.find_one({"kind": "course", "ref": course_id}, sort=[("rejected_at", -1)])
+        assert rejection and rejection["url"] == url and rejection["reason"]
+        assert rejection["rejected_at"] >= time.time() - 60
+    else:
+        # a missing calendar is not a rejected one
+        assert res.status_code == 404
+        assert REJECTED_COL.count_documents({"kind": "course", "ref": course_id}) == 0
+
+    COURSE_CACHE_COL.delete_one({"_id": entry})
+    NEGATIVE_CACHE_COL.delete_many({"kind": "course", "ref": course_id})
+    REJECTED_COL.delete_many({"kind": "course", "ref": course_id})
+
+    print("[LOG] Test passed")
+
+    return 1
+
+def test_change_feeds():
+    print("[LOG] Testing the Atom and RSS feeds of the schedule changes")
+
+    doc1 = SUBJECT_CACHE_COL.aggregate([{ "$sample": { "size": 1 } }]).next()
+
+    res = requests.get(f"{URL}cshorten?has_base_calendar=false&url=&subjects=dsanidua~dsdasdsa&extra_subjects={doc1['id']}")
+    assert res.ok
+    short = json.loads(res.text)['shortened'].split('/')[-1]
+
+    now = int(time.time())
+    marker = ''.join(random.choices(string.ascii_letters, k=10))
+    inserted = SCHEDULE_CHANGES_COL.insert_many([
+        {"kind": "subject", "ref": doc1['id'], "subject": doc1['id'], "change": "added", "summary": f"{marker} first",
+         "new_start": now + 86400, "new_end": now + 90000, "new_location": "A-11", "detected_at": now - 60},
+        {"kind": "subject", "ref": doc1['id'], "subject": doc1['id'], "change": "moved", "summary": f"{marker} second",
+         "old_start": now + 86400, "old_end": now + 90000, "new_start": now + 172800, "new_end": now + 176400, "detected_at": now},
+    ]).inserted_ids
+
+    atom = "{http://www.w3.org/2005/Atom}"
+
+    res = requests.get(f"{URL}cs/{short}/changes.atom")
+    assert res.ok
+    assert res.headers["Content-Type"].startswith("application/atom+xml")
+    feed = ET.fromstring(res.content)
+    assert feed.tag == f"{atom}feed"
+    titles = [e.find(f"{atom}title").text for e in feed.findall(f"{atom}entry")]
+    # newest first
+    assert titles.index(f"Moved: {marker} second") < titles.index(f"Added: {marker} first")
+    entry = feed.findall(f"{atom}entry")[titles.index(f"Added: {marker} first")]
+    assert entry.find(f"{atom}category").get("term") == "added"
+    assert entry.find(f"{atom}summary").text.startswith("Added on ")
+
+    res = requests.get(f"{URL}cs/{short}/changes.rss", params={"tz": "Europe/Zurich"})
+    assert res.ok
+    assert res.headers["Content-Type"].startswith("application/rss+xml")
+    rss = ET.fromstring(res.content)
+    assert rss.tag == "rss" and rss.get("version") == "2.0"
+    items = rss.find("channel").findall("item")
+    titles = [item.find("title").text for item in items]
+    assert f"Moved: {marker} second" in titles and f"Added: {marker} first" in titles
+    item = items[titles.index(f"Moved: {marker} second")]
+    assert item.find("category").text == "moved"
+    assert item.find("description").text.startswith("Moved from ")
+
+    res = requests.get(f"{URL}cs/{short}/changes.atom", params={"limit": 1})
+    assert res.ok
+    assert len(ET.fromstring(res.content).findall(f"{atom}entry")) == 1
+
+    for params in [{"limit": 0}, {"limit": 201}, {"tz": "Mars/Olympus"}]:
+        res = requests.get(f"{URL}cs/{short}/changes.rss", params=params)
+        assert res.status_code == 400, params
+
+    res = requests.get(f"{URL}s/{''.join(random.choices(string.ascii_letters, k=14))}/changes.atom")
+    assert res.status_code == 404
+
+    SCHEDULE_CHANGES_COL.delete_many({"_id": {"$in": inserted}})
+    remove_complex_from_db(short)
+
+    print("[LOG] Test passed")
+
+    return 1
+
+def test_adaptive_ttl():
+
+    print("[LOG] Testing that detected changes shorten the cache ttl")
+
+    doc1 = SUBJECT_CACHE_COL.aggregate([{ "$match": { "size": { "$gt": 0 } } }, { "$sample": { "size": 1 } }]).next()
+
+    res = requests.get(f"{URL}cshorten?has_base_calendar=false&url=&subjects=dsanidua~dsdasdsa&extra_subjects={doc1['id']}")
+    assert res.ok
+    short = json.loads(res.text)['shortened'].split('/')[-1]
+
+    # a fresh entry is not refreshed
+    SUBJECT_CACHE_COL.update_one({'_id':doc1['_id']},{ "$set": { "date_added": 976057200, "expires_at": int(time.time()) + 3600 } })
+    res = requests.get(f'{URL}cs/{short}')
+    assert res.ok
+    assert SUBJECT_CACHE_COL.find_one({'_id':doc1['_id']})['date_added'] == 976057200
+
+    # drop the first event so that the refresh detects a change
+    data = cached_data(doc1)
+    start = data.index("BEGIN:VEVENT")
+    end = data.index("END:VEVENT", start) + len("END:VEVENT")
+    end += len(data[end:]) - len(data[end:].lstrip("\r\n"))
+    SUBJECT_CACHE_COL.update_one({'_id':doc1['_id']},{ "$set": { "data_gz": gzip.compress((data[:start] + data[end:]).encode()), **EXPIRED } })
+
+    before = int(time.time())
+    res = requests.get(f'{URL}cs/{short}')
+    assert res.ok
+
+    ttl = None
+    for _ in range(30):
+        doc1_new = SUBJECT_CACHE_COL.find_one({'_id':doc1['_id']})
+        changed = SCHEDULE_CHANGES_COL.count_documents({"kind": "subject", "ref": doc1['id'], "detected_at": { "$gte": before }})
+        if changed and doc1_new['date_added'] >= before:
+            ttl = doc1_new['expires_at'] - doc1_new['date_added']
+            # the ttl is shortened once the changes are stored
+            if ttl <= max(CACHE_TTL // 4, CACHE_MIN_TTL):
+                break
+        time.sleep(0.5)
+
+    assert ttl is not None
+    assert CACHE_MIN_TTL <= ttl <= max(CACHE_TTL // 4, CACHE_MIN_TTL)
+
+    remove_complex_from_db(short)
+
+    print("[LOG] Test passed")
+
+    return 1
+
+
+def test_admin_api():
+
+    print("[LOG] Testing the cache administration api")
+
+    res = requests.get(f"{URL}admin/cache?kind=subject")
+    assert res.status_code == 401
+
+    res = requests.get(f"{URL}admin/cache?kind=subject&limit=5", headers=ADMIN_HEADERS)
+    assert res.ok
+    entries = json.loads(res.text)['entries']
+    assert 0 < len(entries) <= 5
+    assert all('age_seconds' in e and 'size' in e for e in entries)
+
+    res = requests.get(f"{URL}admin/cache?kind=nothing", headers=ADMIN_HEADERS)
+    assert res.status_code == 400
+
+    doc1 = SUBJECT_CACHE_COL.aggregate([{ "$sample": { "size": 1 } }]).next()
+
+    # a forced refresh ignores the age of the entry
+    res = requests.post(f"{URL}admin/cache/subject/{doc1['id']}/refresh", headers=ADMIN_HEADERS)
+    assert res.ok
+    assert SUBJECT_CACHE_COL.find_one({'_id':doc1['_id']})['date_added'] >= doc1['date_added']
+
+    res = requests.delete(f"{URL}admin/cache/subject/{doc1['id']}", headers=ADMIN_HEADERS)
+    assert res.status_code == 204
+    assert SUBJECT_CACHE_COL.find_one({'id':doc1['id']}) is None
+
+    res = requests.delete(f"{URL}admin/cache/subject/{doc1['id']}", headers=ADMIN_HEADERS)
+    assert res.status_code == 404
+
+    # refreshing a purged entry fetches it again
+    res = requests.post(f"{URL}admin/cache/subject/{doc1['id']}/refresh", headers=ADMIN_HEADERS)
+    assert res.ok
+    assert SUBJECT_CACHE_COL.find_one({'id':doc1['id']}) is not None
+
+    res = requests.post(f"{URL}admin/warmup", headers=ADMIN_HEADERS)
+    assert res.status_code in (202, 409)
+
+    res = requests.get(f"{URL}admin/warmup", headers=ADMIN_HEADERS)
+    assert res.ok
+    assert json.loads(res.text)['started_at'] > 0
+
+    print("[LOG] Test passed")
+
+    return 1
+
+
 def main():
     assert test_random_existing_should_not_add_entry() != -1
     assert test_non_existing_shortened() != -1
@@ -487,11 +1295,29 @@ def main():
     assert test_info_all_calendars() != -1
     assert test_shorten_route() == 1
     assert test_s_route() == 1
+    assert test_link_option_overrides() == 1
+    assert test_calendar_formats() == 1
+    assert test_spreadsheet_exports() == 1
+    assert test_course_url_forms() == 1
+    assert test_upstream_stats() == 1
+    assert test_upstream_rate_limit() == 1
+    assert test_timetable_navigation() == 1
+    assert test_freetime() == 1
+    assert test_next_events() == 1
+    assert test_recurrence_round_trip() == 1
     assert test_complete_process_n(100) != -1
     assert test_complex_cal_shorten_wrapper(100) == 1
     assert test_course_cache() == 1
     assert test_subject_cache() == 1
     assert test_cshorten_route() == 1
+    assert test_cache_compression() == 1
+    assert test_webhook() == 1
+    assert test_adaptive_ttl() == 1
+    assert test_calendar_history() == 1
+    assert test_negative_cache() == 1
+    assert test_rejected_refresh() == 1
+    assert test_change_feeds() == 1
+    assert test_admin_api() == 1
 
 if __name__ == "__main__":
     main()
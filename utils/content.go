@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"errors"
+	"mime"
+)
+
+// Largest body read from search.usi.ch, UPSTREAM_MAX_BODY_BYTES
+var MaxUpstreamBody = int64(IntFromEnv("UPSTREAM_MAX_BODY_BYTES", 5<<20))
+
+var (
+	// Wrapped in ErrUpstream when a body is larger than MaxUpstreamBody
+	ErrBodyTooLarge = errors.New("body too large")
+	// Wrapped in ErrUpstream when a body has a content type that is not expected, such as an html error page
+	ErrUnexpectedContent = errors.New("unexpected content type")
+	// Wrapped in ErrUpstream when a body is not a well formed calendar
+	ErrInvalidCalendar = errors.New("invalid calendar")
+)
+
+// Media types search.usi.ch may serve a calendar with
+var calendarContentTypes = []string{"text/calendar", "application/ics", "text/plain", "application/octet-stream"}
+
+// Whether contentType is one of the accepted media types, a missing content type is accepted
+func acceptedContentType(contentType string, accept []string) bool {
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		return false
+	}
+
+	for _, a := range accept {
+		if mediaType == a {
+			return true
+		}
+	}
+
+	return false
+}
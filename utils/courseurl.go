@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	UpstreamHost = "search.usi.ch"
+	// Path section of the course calendars
+	courseSection = "educations"
+)
+
+var (
+	courseIDPattern   = regexp.MustCompile(`^[0-9]+$`)
+	languagePattern   = regexp.MustCompile(`^[a-z]{2}$`)
+	semesterPattern   = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+	subjectIDPattern  = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+	courseSlugPattern = regexp.MustCompile(`^([0-9A-Za-z_.%-]+|\*)$`)
+)
+
+// Course calendar of search.usi.ch, parsed from an url of the form
+// https://search.usi.ch[/<language>]/educations/<id>[/<slug>]/schedules[/<semester>]/ics
+type CourseRef struct {
+	ID       string
+	Language string
+	Semester string
+}
+
+// Parses a course calendar url, ErrInvalidInput for anything else, including urls
+// to other hosts, with credentials, ports, query parameters or fragments
+func ParseCourseUrl(raw string) (*CourseRef, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+
+	if err != nil {
+		return nil, Errorf(ErrInvalidInput, nil, "%q is not an url", raw)
+	}
+
+	if u.Scheme != "https" || !strings.EqualFold(u.Host, UpstreamHost) || u.User != nil || u.Port() != "" {
+		return nil, Errorf(ErrInvalidInput, nil, "%q is not a https://%s/ url", raw, UpstreamHost)
+	}
+
+	if u.RawQuery != "" || u.Fragment != "" || u.Opaque != "" {
+		return nil, Errorf(ErrInvalidInput, nil, "%q has query parameters or a fragment", raw)
+	}
+
+	segments := strings.Split(strings.Trim(u.EscapedPath(), "/"), "/")
+
+	var ref CourseRef
+
+	if len(segments) > 0 && languagePattern.MatchString(strings.ToLower(segments[0])) {
+		ref.Language = strings.ToLower(segments[0])
+		segments = segments[1:]
+	}
+
+	if len(segments) < 4 || segments[0] != courseSection || !courseIDPattern.MatchString(segments[1]) {
+		return nil, Errorf(ErrInvalidInput, nil, "%q is not a course calendar url", raw)
+	}
+
+	ref.ID = segments[1]
+	segments = segments[2:]
+
+	// optional slug, ignored by search.usi.ch
+	if segments[0] != "schedules" {
+		if !courseSlugPattern.MatchString(segments[0]) {
+			return nil, Errorf(ErrInvalidInput, nil, "%q is not a course calendar url", raw)
+		}
+		segments = segments[1:]
+	}
+
+	switch {
+	case len(segments) == 2 && segments[0] == "schedules" && segments[1] == "ics":
+	case len(segments) == 3 && segments[0] == "schedules" && segments[2] == "ics" && semesterPattern.MatchString(segments[1]):
+		ref.Semester = segments[1]
+	default:
+		return nil, Errorf(ErrInvalidInput, nil, "%q is not a course calendar url", raw)
+	}
+
+	return &ref, nil
+}
+
+// Canonical url of the course calendar, the same for every url ParseCourseUrl reads into ref
+func (ref CourseRef) Url() string {
+	var sb strings.Builder
+
+	sb.WriteString("https://" + UpstreamHost + "/")
+
+	if ref.Language != "" {
+		sb.WriteString(ref.Language + "/")
+	}
+
+	sb.WriteString(courseSection + "/" + ref.ID + "/*/schedules/")
+
+	if ref.Semester != "" {
+		sb.WriteString(ref.Semester + "/")
+	}
+
+	sb.WriteString("ics")
+
+	return sb.String()
+}
+
+// Canonical form of a course calendar url
+func CanonicalCourseUrl(raw string) (string, error) {
+	ref, err := ParseCourseUrl(raw)
+
+	if err != nil {
+		return "", err
+	}
+
+	return ref.Url(), nil
+}
+
+// Url of the calendar of a subject, ErrInvalidInput if id cannot be part of the path
+func SubjectCalendarUrl(id string) (string, error) {
+	if !subjectIDPattern.MatchString(id) {
+		return "", Errorf(ErrInvalidInput, nil, "%q is not a subject id", id)
+	}
+
+	return "https://" + UpstreamHost + "/courses/" + id + "/*/schedules/ics", nil
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Kinds of failures, wrapped by the errors returned across packages so that
+// the routes can tell them apart with errors.Is
+var (
+	// The request is malformed or refers to subjects that do not exist
+	ErrInvalidInput = errors.New("invalid input")
+	// The short link, webhook or upstream calendar does not exist
+	ErrNotFound = errors.New("not found")
+	// The resource exists already or a limit on it was reached
+	ErrConflict = errors.New("conflict")
+	// search.usi.ch could not be reached or answered with an error or an invalid calendar
+	ErrUpstream = errors.New("upstream error")
+	// The database failed
+	ErrDatabase = errors.New("database error")
+	// The request, the database or search.usi.ch took too long
+	ErrTimeout = errors.New("timeout")
+	// The request lacks valid credentials for an admin endpoint
+	ErrUnauthorized = errors.New("unauthorized")
+	// The client made too many requests of this kind recently
+	ErrTooManyRequests = errors.New("too many requests")
+)
+
+// Wraps err, which may be nil, in one of the error kinds above with a description
+func Errorf(kind error, err error, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+
+	if err == nil {
+		return fmt.Errorf("%w: %s", kind, message)
+	}
+
+	return fmt.Errorf("%w: %s: %w", kind, message, err)
+}
+
+// Error kind of a failed network or database call: ErrTimeout when a deadline expired, otherwise fallback
+func ClassifyError(err error, fallback error) error {
+	var netErr net.Error
+
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrTimeout
+	}
+
+	return fallback
+}
+
+// Status of an upstream answer that is not a success
+type StatusError struct {
+	Status int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status %d", e.Status)
+}
+
+// Status of the upstream answer that caused err, 0 when there was none
+func UpstreamStatus(err error) int {
+	var statusErr *StatusError
+
+	if errors.As(err, &statusErr) {
+		return statusErr.Status
+	}
+
+	return 0
+}
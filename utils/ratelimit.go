@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	// Requests per second sent to search.usi.ch on average, UPSTREAM_RATE_PER_SECOND
+	upstreamRate = IntFromEnv("UPSTREAM_RATE_PER_SECOND", 5)
+	// Requests that can be sent at once after a quiet period, UPSTREAM_BURST
+	upstreamBurst = IntFromEnv("UPSTREAM_BURST", 10)
+	// Requests in flight to the same host, UPSTREAM_MAX_CONCURRENCY
+	upstreamConcurrency = IntFromEnv("UPSTREAM_MAX_CONCURRENCY", 4)
+	// Requests waiting for their turn, beyond which new ones are refused, UPSTREAM_MAX_QUEUE
+	upstreamMaxQueue = IntFromEnv("UPSTREAM_MAX_QUEUE", 100)
+)
+
+// Wrapped in ErrUpstream when a request is refused because too many are already waiting
+var ErrRateLimited = errors.New("too many requests queued for search.usi.ch")
+
+// Token bucket shared by every request to search.usi.ch. Tokens are reserved in
+// arrival order and may go negative, the deficit is the wait of the latest request.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+var upstreamBucket = &tokenBucket{tokens: float64(upstreamBurst), last: time.Now()}
+
+// Takes a token and returns how long to wait before using it
+func (b *tokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(upstreamRate)
+	b.last = now
+
+	if b.tokens > float64(upstreamBurst) {
+		b.tokens = float64(upstreamBurst)
+	}
+
+	b.tokens--
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / float64(upstreamRate) * float64(time.Second))
+}
+
+// Gives back a token reserved by a request that gave up waiting
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens++
+}
+
+// Semaphores limiting the requests in flight to each host
+var hostSlots = struct {
+	sync.Mutex
+	byHost map[string]chan struct{}
+}{byHost: make(map[string]chan struct{})}
+
+func hostSlot(rawUrl string) chan struct{} {
+	host := rawUrl
+	if u, err := url.Parse(rawUrl); err == nil {
+		host = u.Host
+	}
+
+	hostSlots.Lock()
+	defer hostSlots.Unlock()
+
+	slot, ok := hostSlots.byHost[host]
+	if !ok {
+		slot = make(chan struct{}, upstreamConcurrency)
+		hostSlots.byHost[host] = slot
+	}
+
+	return slot
+}
+
+// Waits for a token and for a free slot of the host of rawUrl. The returned func frees the slot.
+func acquireUpstream(ctx context.Context, rawUrl string) (func(), error) {
+	upstream.mu.Lock()
+	if upstream.stats.Waiting >= int64(upstreamMaxQueue) {
+		upstream.stats.QueueFull++
+		upstream.mu.Unlock()
+		return nil, Errorf(ErrUpstream, ErrRateLimited, "GET %s", rawUrl)
+	}
+	upstream.stats.Waiting++
+	upstream.mu.Unlock()
+
+	defer func() {
+		upstream.mu.Lock()
+		upstream.stats.Waiting--
+		upstream.mu.Unlock()
+	}()
+
+	if wait := upstreamBucket.reserve(); wait > 0 {
+		upstream.mu.Lock()
+		upstream.stats.Delayed++
+		upstream.mu.Unlock()
+
+		if !sleepContext(ctx, wait) {
+			upstreamBucket.cancel()
+			return nil, Errorf(ClassifyError(ctx.Err(), ErrUpstream), ctx.Err(), "waiting to GET %s", rawUrl)
+		}
+	}
+
+	slot := hostSlot(rawUrl)
+
+	select {
+	case slot <- struct{}{}:
+		return func() { <-slot }, nil
+	case <-ctx.Done():
+		return nil, Errorf(ClassifyError(ctx.Err(), ErrUpstream), ctx.Err(), "waiting to GET %s", rawUrl)
+	}
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Deadline of a whole API request, REQUEST_TIMEOUT_MS
+var RequestTimeout = DurationFromEnv("REQUEST_TIMEOUT_MS", 30*time.Second)
+
+// Deadline of a single request to search.usi.ch, UPSTREAM_TIMEOUT_MS
+var UpstreamTimeout = DurationFromEnv("UPSTREAM_TIMEOUT_MS", 15*time.Second)
+
+// Deadline of a single database operation, DB_TIMEOUT_MS
+var DBTimeout = DurationFromEnv("DB_TIMEOUT_MS", 5*time.Second)
+
+// Reads a duration in milliseconds from the environment, def when unset or invalid
+func DurationFromEnv(name string, def time.Duration) time.Duration {
+	ms, err := strconv.Atoi(os.Getenv(name))
+
+	if err != nil || ms <= 0 {
+		return def
+	}
+
+	return time.Duration(ms) * time.Millisecond
+}
+
+// Reads a positive integer from the environment, def when unset or invalid
+func IntFromEnv(name string, def int) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+
+	if err != nil || n <= 0 {
+		return def
+	}
+
+	return n
+}
@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Attempts made for a request failing with a transient error, UPSTREAM_ATTEMPTS
+	upstreamAttempts = IntFromEnv("UPSTREAM_ATTEMPTS", 3)
+	// Delay before the first retry, doubled at every retry, UPSTREAM_RETRY_DELAY_MS
+	upstreamRetryDelay = DurationFromEnv("UPSTREAM_RETRY_DELAY_MS", 250*time.Millisecond)
+	// Consecutive failed attempts that open the circuit breaker, UPSTREAM_BREAKER_THRESHOLD
+	breakerThreshold = IntFromEnv("UPSTREAM_BREAKER_THRESHOLD", 5)
+	// Time the circuit breaker stays open before a trial request is let through, UPSTREAM_BREAKER_COOLDOWN_MS
+	breakerCooldown = DurationFromEnv("UPSTREAM_BREAKER_COOLDOWN_MS", 30*time.Second)
+)
+
+// Wrapped in ErrUpstream when a request is not sent because the circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// State and counters of the client used for search.usi.ch
+type UpstreamStats struct {
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	OpenedAt            int64  `json:"opened_at,omitempty"`
+	Requests            int64  `json:"requests"`
+	Attempts            int64  `json:"attempts"`
+	Retries             int64  `json:"retries"`
+	Failures            int64  `json:"failures"`
+	Rejected            int64  `json:"rejected"`
+	Trips               int64  `json:"trips"`
+	// Requests currently waiting for the rate limiter
+	Waiting int64 `json:"waiting"`
+	// Requests that had to wait for a token
+	Delayed int64 `json:"delayed"`
+	// Requests refused because upstreamMaxQueue were already waiting
+	QueueFull int64 `json:"queue_full"`
+}
+
+var upstreamClient = &http.Client{
+	Timeout:       UpstreamTimeout,
+	CheckRedirect: checkUpstreamRedirect,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: UpstreamTimeout,
+		MaxIdleConns:          20,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// Only follows redirects that stay on https://search.usi.ch, so that an upstream answer
+// cannot point the server to another host
+func checkUpstreamRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 5 {
+		return Errorf(ErrUpstream, nil, "too many redirects")
+	}
+
+	if req.URL.Scheme != "https" || !strings.EqualFold(req.URL.Host, UpstreamHost) {
+		return Errorf(ErrUpstream, nil, "redirect to %s refused", req.URL.Redacted())
+	}
+
+	return nil
+}
+
+// Stops sending requests to search.usi.ch after breakerThreshold consecutive failures.
+// Once breakerCooldown has passed a single trial request is let through (half open):
+// the breaker closes if it succeeds and opens again if it fails.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool
+	stats    UpstreamStats
+}
+
+var upstream = &circuitBreaker{state: BreakerClosed}
+
+// Whether an attempt may be sent
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= breakerCooldown {
+		b.state = BreakerHalfOpen
+	}
+
+	if b.state == BreakerOpen || (b.state == BreakerHalfOpen && b.trial) {
+		b.stats.Rejected++
+		return false
+	}
+
+	b.trial = b.state == BreakerHalfOpen
+	b.stats.Attempts++
+
+	return true
+}
+
+// Records the outcome of an attempt. Answers such as 404 count as successes,
+// the upstream is working.
+func (b *circuitBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+
+	if ok {
+		if b.state != BreakerClosed {
+			Logger.Println("Upstream circuit breaker closed")
+		}
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	b.stats.Failures++
+
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= breakerThreshold) {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+		b.stats.Trips++
+		Logger.Printf("Upstream circuit breaker open after %d consecutive failures\n", b.failures)
+	}
+}
+
+// Forgets an attempt abandoned by the caller, which says nothing about the upstream
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
+
+// Takes back an allowed attempt that was never sent, because the rate limiter refused it
+func (b *circuitBreaker) withdraw() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	b.stats.Attempts--
+}
+
+func (b *circuitBreaker) count(requests int64, retries int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.stats.Requests += requests
+	b.stats.Retries += retries
+}
+
+// Current state and counters of the upstream client
+func UpstreamState() UpstreamStats {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	stats := upstream.stats
+	stats.State = upstream.state
+	stats.ConsecutiveFailures = upstream.failures
+
+	if upstream.state != BreakerClosed {
+		stats.OpenedAt = upstream.openedAt.Unix()
+	}
+
+	return stats
+}
+
+// Delay before the given retry: upstreamRetryDelay doubled at every retry, minus up to half of it at random
+func retryDelay(retry int) time.Duration {
+	delay := upstreamRetryDelay << (retry - 1)
+
+	return delay - time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// Waits d unless ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
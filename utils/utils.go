@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"io"
 	"log"
 	"math/rand"
@@ -41,39 +42,114 @@ func RandStringBytesMaskImprSrcSB(n int) string {
 	return sb.String()
 }
 
-func SimpleGetRequest(url *string) (*string, bool) {
+// GET request to search.usi.ch through the circuit breaker and the rate limiter, retrying network errors,
+// 429 and 5xx answers up to upstreamAttempts times with a jittered exponential backoff.
+// Bodies larger than MaxUpstreamBody are refused.
+func SimpleGetRequest(ctx context.Context, url *string) (*string, error) {
+	return getWithRetries(ctx, url, nil)
+}
+
+// SimpleGetRequest that also refuses answers whose content type is not one a calendar is served with
+func GetCalendarRequest(ctx context.Context, url *string) (*string, error) {
+	return getWithRetries(ctx, url, calendarContentTypes)
+}
 
-	var resp *http.Response
+func getWithRetries(ctx context.Context, url *string, accept []string) (*string, error) {
+
+	var body *string
 	var err error
+	var transient bool
+
+	attempt := 1
+
+	defer func() { upstream.count(1, int64(attempt-1)) }()
+
+	for ; ; attempt++ {
+		// a rejected attempt neither spends a token nor waits for a slot
+		if !upstream.allow() {
+			return nil, Errorf(ErrUpstream, ErrCircuitOpen, "GET %s", *url)
+		}
+
+		done, waitErr := acquireUpstream(ctx, *url)
+
+		if waitErr != nil {
+			upstream.withdraw()
+			return nil, waitErr
+		}
+
+		body, transient, err = getOnce(ctx, url, accept)
+		done()
+
+		if err != nil && transient && ctx.Err() != nil {
+			upstream.release()
+			return nil, err
+		}
+
+		upstream.record(err == nil || !transient)
+
+		if err == nil || !transient || attempt >= upstreamAttempts {
+			return body, err
+		}
+
+		if !sleepContext(ctx, retryDelay(attempt)) {
+			return nil, err
+		}
+	}
+}
+
+// Single attempt of getWithRetries, transient tells whether the failure is worth a retry.
+// accept lists the allowed media types, nil for any.
+func getOnce(ctx context.Context, url *string, accept []string) (*string, bool, error) {
 
-	resp, err = http.Get(*url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, *url, nil)
 
 	if err != nil {
-		return nil, true
+		return nil, false, Errorf(ErrInvalidInput, err, "GET %s", *url)
 	}
 
-	if (int)(resp.StatusCode/100) > 3 {
-		return nil, true
+	resp, err := upstreamClient.Do(req)
+
+	if err != nil {
+		return nil, true, Errorf(ClassifyError(err, ErrUpstream), err, "GET %s", *url)
 	}
 
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, Errorf(ErrNotFound, &StatusError{resp.StatusCode}, "GET %s", *url)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return nil, true, Errorf(ErrUpstream, &StatusError{resp.StatusCode}, "GET %s", *url)
+	}
+
+	if (int)(resp.StatusCode/100) > 3 {
+		return nil, false, Errorf(ErrUpstream, &StatusError{resp.StatusCode}, "GET %s", *url)
+	}
+
+	if accept != nil && !acceptedContentType(resp.Header.Get("Content-Type"), accept) {
+		return nil, false, Errorf(ErrUpstream, ErrUnexpectedContent, "GET %s: content type %q", *url, resp.Header.Get("Content-Type"))
+	}
+
+	if resp.ContentLength > MaxUpstreamBody {
+		return nil, false, Errorf(ErrUpstream, ErrBodyTooLarge, "GET %s: %d bytes", *url, resp.ContentLength)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxUpstreamBody+1))
 
 	if err != nil {
-		return nil, true
+		return nil, true, Errorf(ClassifyError(err, ErrUpstream), err, "GET %s", *url)
+	}
+
+	if int64(len(body)) > MaxUpstreamBody {
+		return nil, false, Errorf(ErrUpstream, ErrBodyTooLarge, "GET %s: more than %d bytes", *url, MaxUpstreamBody)
 	}
 
 	var stringBody string = string(body)
 
-	return &stringBody, false
+	return &stringBody, false, nil
 }
 
 func IsCalendarValid(cal *string) bool {
-	for i := 0; i < len(calValidator); i++ {
-		if (*cal)[i] != calValidator[i] {
-			return false
-		}
-	}
-	return true
+	return cal != nil && strings.HasPrefix(*cal, calValidator)
 }
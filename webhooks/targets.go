@@ -0,0 +1,88 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+
+	utils "usicalendar/utils"
+)
+
+// Lets webhooks target loopback and private addresses, WEBHOOK_ALLOW_PRIVATE_TARGETS=true.
+// Only meant for local testing, anyone who can create a link could otherwise reach internal services.
+var allowPrivateTargets = os.Getenv("WEBHOOK_ALLOW_PRIVATE_TARGETS") == "true"
+
+// Ranges that are neither private nor loopback for package net but are not public either
+var reservedNets = parseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, nets[i], _ = net.ParseCIDR(cidr)
+	}
+	return nets
+}
+
+// Whether a webhook may not be delivered to ip: loopback, private, link-local (cloud metadata
+// services included), unspecified, multicast and reserved addresses
+func forbiddenIP(ip net.IP) bool {
+	if allowPrivateTargets {
+		return false
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+
+	for _, reserved := range reservedNets {
+		if reserved.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks that raw is an http(s) url whose host only resolves to public addresses,
+// ErrInvalidInput otherwise. Deliveries check the address again when connecting.
+func CheckTarget(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil {
+		return utils.Errorf(utils.ErrInvalidInput, nil, "url must be an http or https url")
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+
+	if err != nil || len(addrs) == 0 {
+		return utils.Errorf(utils.ErrInvalidInput, nil, "the host of url %s cannot be resolved", u.Hostname())
+	}
+
+	for _, addr := range addrs {
+		if forbiddenIP(addr.IP) {
+			return utils.Errorf(utils.ErrInvalidInput, nil, "url must point to a public address")
+		}
+	}
+
+	return nil
+}
+
+// Refuses connections to forbidden addresses once the host has been resolved,
+// so that a DNS change after the registration cannot redirect deliveries
+func checkDialAddress(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || forbiddenIP(ip) {
+		return fmt.Errorf("webhook target %s is not a public address", host)
+	}
+
+	return nil
+}
@@ -0,0 +1,224 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	mh "usicalendar/mongo_connection_handler"
+	utils "usicalendar/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	EventScheduleChanged = "schedule.changed"
+
+	SignatureHeader = "X-Usicalendar-Signature"
+	EventHeader     = "X-Usicalendar-Event"
+	DeliveryHeader  = "X-Usicalendar-Delivery"
+)
+
+const (
+	maxAttempts     = 5
+	firstRetryDelay = 10 * time.Second
+	requestTimeout  = 10 * time.Second
+)
+
+var client = &http.Client{
+	Timeout: requestTimeout,
+	// no proxy, the dialer must see the address of the target
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: requestTimeout,
+			Control: checkDialAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: requestTimeout,
+		MaxIdleConnsPerHost: 2,
+	},
+	// a redirect would send the signed payload somewhere else
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+type payload struct {
+	Event    string              `json:"event"`
+	Delivery string              `json:"delivery"`
+	Link     string              `json:"link"`
+	Complex  bool                `json:"complex"`
+	SentAt   int64               `json:"sent_at"`
+	Changes  []mh.ScheduleChange `json:"changes"`
+}
+
+// Random secret used to sign the payloads sent to a webhook
+func NewSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Stored form of the token managing a webhook
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Value of the signature header: hex encoded HMAC-SHA256 of the body with the webhook secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notifies the webhooks whose links contain the subjects of the changes found in a cache entry.
+// kind and ref identify the cache entry as in mh.ScheduleChange. Deliveries run in the background.
+func Notify(kind string, ref string, changes []mh.ScheduleChange) {
+	var filter bson.D
+
+	switch kind {
+	case mh.CacheKindCourse:
+		filter = bson.D{{Key: "course", Value: ref}}
+	case mh.CacheKindSubject:
+		filter = bson.D{{Key: "extra_subjects", Value: ref}}
+	default:
+		return
+	}
+
+	cursor, err := mh.WebhooksColl.Find(context.Background(), filter)
+
+	if err != nil {
+		utils.Logger.Println("Could not look up webhooks: " + err.Error())
+		return
+	}
+
+	var hooks []mh.Webhook
+
+	if err := cursor.All(context.Background(), &hooks); err != nil {
+		utils.Logger.Println("Could not look up webhooks: " + err.Error())
+		return
+	}
+
+	for i := range hooks {
+		relevant := changes
+
+		if kind == mh.CacheKindCourse {
+			relevant = nil
+			for _, change := range changes {
+				if contains(hooks[i].Subjects, change.Subject) {
+					relevant = append(relevant, change)
+				}
+			}
+		}
+
+		if len(relevant) > 0 {
+			go deliver(hooks[i], relevant)
+		}
+	}
+}
+
+// Sends the changes to the webhook, retrying with exponential backoff until
+// the endpoint answers with a 2xx status or maxAttempts is reached
+func deliver(hook mh.Webhook, changes []mh.ScheduleChange) {
+	delivery := mh.WebhookDelivery{
+		ID:        primitive.NewObjectID(),
+		WebhookID: hook.ID,
+		Changes:   len(changes),
+		Attempts:  []mh.WebhookAttempt{},
+		DateAdded: time.Now().Unix(),
+	}
+
+	if _, err := mh.WebhookDeliveriesColl.InsertOne(context.Background(), delivery); err != nil {
+		utils.Logger.Println("Could not log webhook delivery: " + err.Error())
+		return
+	}
+
+	body, err := json.Marshal(payload{
+		Event:    EventScheduleChanged,
+		Delivery: delivery.ID.Hex(),
+		Link:     hook.ShortUrl,
+		Complex:  hook.Complex,
+		SentAt:   time.Now().Unix(),
+		Changes:  changes,
+	})
+
+	if err != nil {
+		return
+	}
+
+	delay := firstRetryDelay
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		result := post(&hook, delivery.ID.Hex(), body)
+		delivered := result.Error == "" && result.Status/100 == 2
+
+		update := bson.D{{Key: "$push", Value: bson.D{{Key: "attempts", Value: result}}}}
+		if delivered {
+			update = append(update, bson.E{Key: "$set", Value: bson.D{{Key: "delivered", Value: true}}})
+		}
+
+		if _, err := mh.WebhookDeliveriesColl.UpdateByID(context.Background(), delivery.ID, update); err != nil {
+			utils.Logger.Println("Could not log webhook delivery: " + err.Error())
+		}
+
+		if delivered {
+			return
+		}
+
+		if attempt < maxAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	utils.Logger.Println("Giving up on webhook " + hook.ID.Hex() + " after " + strconv.Itoa(maxAttempts) + " attempts")
+}
+
+func post(hook *mh.Webhook, deliveryID string, body []byte) mh.WebhookAttempt {
+	attempt := mh.WebhookAttempt{At: time.Now().Unix()}
+
+	req, err := http.NewRequest(http.MethodPost, hook.Url, bytes.NewReader(body))
+
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "usicalendar-webhooks")
+	req.Header.Set(EventHeader, EventScheduleChanged)
+	req.Header.Set(DeliveryHeader, deliveryID)
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, body))
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	resp.Body.Close()
+	attempt.Status = resp.StatusCode
+
+	return attempt
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}